@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// loadConfig reads a JSON config file whose keys are flag names (without the
+// leading dash) and returns each value in the string form flag.Set expects.
+// A scalar gives one string; an array gives one string per element.
+func loadConfig(path string) (map[string][]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config file '%s': %w", path, err)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var raw map[string]interface{}
+	if err := dec.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("invalid JSON in config file '%s': %w", path, err)
+	}
+
+	values := make(map[string][]string, len(raw))
+	for key, v := range raw {
+		var list []string
+		if items, ok := v.([]interface{}); ok {
+			list = make([]string, 0, len(items))
+			for _, item := range items {
+				s, err := configValueString(item)
+				if err != nil {
+					return nil, fmt.Errorf("config file '%s': key %q: %w", path, key, err)
+				}
+				list = append(list, s)
+			}
+		} else {
+			s, err := configValueString(v)
+			if err != nil {
+				return nil, fmt.Errorf("config file '%s': key %q: %w", path, key, err)
+			}
+			list = []string{s}
+		}
+		values[key] = list
+	}
+	return values, nil
+}
+
+func configValueString(v interface{}) (string, error) {
+	switch val := v.(type) {
+	case string:
+		return val, nil
+	case json.Number:
+		return val.String(), nil
+	case bool:
+		return strconv.FormatBool(val), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v (want string, number, bool or array of those)", v)
+	}
+}
+
+// repeatableFlag is a flag.Value that collects one value per use, like
+// -header. A config array sets it once per element instead of once with
+// the elements joined by commas.
+type repeatableFlag interface {
+	flag.Value
+	repeatable()
+}
+
+// applyConfig sets every flag named in values that was not given explicitly
+// on the command line, so precedence is defaults < config file < flags.
+// Arrays are joined with commas for list-valued flags.
+func applyConfig(fs *flag.FlagSet, path string, values map[string][]string) error {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		f := fs.Lookup(key)
+		if key == "config" || f == nil {
+			return fmt.Errorf("unknown key %q in config file '%s' (keys are flag names without the dash, e.g. \"rate\", \"workers\"; run with -h for the full list)", key, path)
+		}
+		if explicit[key] {
+			continue
+		}
+		list := values[key]
+		if _, ok := f.Value.(repeatableFlag); !ok {
+			list = []string{strings.Join(list, ",")}
+		}
+		for _, v := range list {
+			if err := fs.Set(key, v); err != nil {
+				return fmt.Errorf("invalid value for %q in config file '%s': %w", key, path, err)
+			}
+		}
+	}
+	return nil
+}
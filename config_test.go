@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestApplyConfigArrays(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "crt.json")
+	data := `{"header": ["X-A: 1", "X-B: 2"], "exclude": ["www.*", "dev.*"], "rate": 2}`
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	var headers headerFlag
+	fs.Var(&headers, "header", "")
+	exclude := fs.String("exclude", "", "")
+	rate := fs.Float64("rate", 1, "")
+
+	values, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfig(fs, path, values); err != nil {
+		t.Fatal(err)
+	}
+
+	// A repeatable flag gets one Set per element
+	if got := headers.header.Get("X-A"); got != "1" {
+		t.Errorf("X-A = %q, want 1", got)
+	}
+	if got := headers.header.Get("X-B"); got != "2" {
+		t.Errorf("X-B = %q, want 2", got)
+	}
+	if *exclude != "www.*,dev.*" {
+		t.Errorf("exclude = %q, want %q", *exclude, "www.*,dev.*")
+	}
+	if *rate != 2 {
+		t.Errorf("rate = %v, want 2", *rate)
+	}
+}
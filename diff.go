@@ -0,0 +1,48 @@
+package main
+
+// runDiff compares two result files and prints the names only in newPath as
+// "+name" and the names only in oldPath as "-name". crt.sh is not queried.
+func runDiff(oldPath, newPath, sortMode string) error {
+	oldNames, err := readNameFile(oldPath)
+	if err != nil {
+		return err
+	}
+	newNames, err := readNameFile(newPath)
+	if err != nil {
+		return err
+	}
+
+	oldSet := nameSet(oldNames)
+	newSet := nameSet(newNames)
+
+	added := sortedSet(setDifference(newSet, oldSet), sortMode)
+	removed := sortedSet(setDifference(oldSet, newSet), sortMode)
+
+	for _, n := range added {
+		emitResult("+" + n)
+	}
+	for _, n := range removed {
+		emitResult("-" + n)
+	}
+	logInfo(logFields{}, "%d added, %d removed, %d unchanged", len(added), len(removed), newSet.Len()-len(added))
+	return nil
+}
+
+func nameSet(names []string) *StringSet {
+	set := NewStringSet()
+	for _, n := range names {
+		set.Add(normalizeDomain(n))
+	}
+	return set
+}
+
+// setDifference returns the names in a that are not in b.
+func setDifference(a, b *StringSet) *StringSet {
+	out := NewStringSet()
+	for _, n := range a.Sorted() {
+		if !b.Contains(n) {
+			out.Add(n)
+		}
+	}
+	return out
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// runExpand combines every wildcard root in rootsPath with every word in
+// wordsPath into "word.root" candidates for a bruteforce, printed to stdout
+// or written to outPath. crt.sh is not queried.
+func runExpand(rootsPath, wordsPath, outPath, sortMode string) error {
+	rawRoots, err := readNameFile(rootsPath)
+	if err != nil {
+		return err
+	}
+	roots, _, _ := prepareDomains(rawRoots)
+	sortNames(roots, sortMode)
+
+	rawWords, err := readNameFile(wordsPath)
+	if err != nil {
+		return err
+	}
+	var words []string
+	seenWords := make(map[string]struct{})
+	dotted := false
+	for _, w := range rawWords {
+		w = strings.TrimPrefix(normalizeDomain(w), ".")
+		if w == "" {
+			continue
+		}
+		if _, ok := seenWords[w]; ok {
+			continue
+		}
+		seenWords[w] = struct{}{}
+		words = append(words, w)
+		dotted = dotted || strings.Contains(w, ".")
+	}
+
+	emit := emitResult
+	var f *os.File
+	var out *bufio.Writer
+	if outPath != "" {
+		f, err = os.Create(outPath)
+		if err != nil {
+			return fmt.Errorf("could not create '%s': %w", outPath, err)
+		}
+		defer f.Close()
+		out = bufio.NewWriter(f)
+		emit = func(line string) {
+			out.WriteString(line)
+			out.WriteByte('\n')
+		}
+	}
+
+	// With unique roots and words, "word.root" can only repeat when a word
+	// has a dot ("a.b" + "example.com" = "a" + "b.example.com"). Only then
+	// are the candidates remembered, since the product can be huge.
+	var seen *StringSet
+	if dotted {
+		seen = NewStringSet()
+	}
+
+	written, invalid := 0, 0
+	for _, root := range roots {
+		for _, word := range words {
+			name := word + "." + root
+			if !isValidDomain(name) {
+				invalid++
+				continue
+			}
+			if seen != nil && !seen.Add(name) {
+				continue
+			}
+			emit(name)
+			written++
+		}
+	}
+
+	if out != nil {
+		if err := out.Flush(); err != nil {
+			return fmt.Errorf("failed to write %s: %w", outPath, err)
+		}
+		if err := f.Close(); err != nil {
+			return fmt.Errorf("failed to write %s: %w", outPath, err)
+		}
+	}
+
+	if invalid > 0 {
+		logWarn(logFields{}, "Skipped %d candidate(s) that are not valid hostnames", invalid)
+	}
+	if outPath != "" {
+		logInfo(logFields{}, "Wrote %d candidate(s) from %d root(s) and %d word(s) to %s", written, len(roots), len(words), outPath)
+	} else {
+		logInfo(logFields{}, "%d candidate(s) from %d root(s) and %d word(s)", written, len(roots), len(words))
+	}
+	return nil
+}
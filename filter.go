@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"regexp"
+	"strings"
+)
+
+// parsePatterns parses a comma-separated list of name patterns. Entries
+// prefixed with "re:" are regular expressions matched anywhere in the name;
+// all others are globs matched against the whole name, where "*" matches any
+// run of characters (dots included) and "?" matches a single character.
+func parsePatterns(list string) ([]*regexp.Regexp, error) {
+	var patterns []*regexp.Regexp
+	for _, p := range strings.Split(list, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+
+		expr := globToRegexp(p)
+		if strings.HasPrefix(p, "re:") {
+			expr = strings.TrimPrefix(p, "re:")
+		}
+
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", p, err)
+		}
+		patterns = append(patterns, re)
+	}
+	return patterns, nil
+}
+
+func globToRegexp(glob string) string {
+	expr := regexp.QuoteMeta(glob)
+	expr = strings.ReplaceAll(expr, `\*`, `.*`)
+	expr = strings.ReplaceAll(expr, `\?`, `.`)
+	return "(?i)^" + expr + "$"
+}
+
+// included reports whether name passes -include: with no patterns every name
+// does, otherwise it has to match at least one.
+func included(patterns []*regexp.Regexp, name string) bool {
+	return len(patterns) == 0 || matchesAny(patterns, name)
+}
+
+// sampled reports whether name is kept by -sample-rate. The decision is a
+// hash of seed and name rather than a random draw, so every worker agrees on
+// it, the order names arrive in doesn't matter, and the same seed always
+// yields the same sample.
+func sampled(rate float64, seed int64, name string) bool {
+	if rate >= 1 {
+		return true
+	}
+	h := fnv.New64a()
+	binary.Write(h, binary.LittleEndian, seed)
+	h.Write([]byte(name))
+	return float64(h.Sum64())/math.MaxUint64 < rate
+}
+
+func matchesAny(patterns []*regexp.Regexp, name string) bool {
+	for _, re := range patterns {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseScope parses a comma-separated list of scope entries. Plain entries are
+// domain suffixes: "example.com" (or "*.example.com") matches example.com and
+// every name below it. Entries prefixed with "re:" are regular expressions.
+func parseScope(list string) ([]*regexp.Regexp, error) {
+	var scope []*regexp.Regexp
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		expr := strings.TrimPrefix(entry, "re:")
+		if !strings.HasPrefix(entry, "re:") {
+			suffix := normalizeDomain(strings.TrimPrefix(entry, "*."))
+			expr = `(^|\.)` + regexp.QuoteMeta(suffix) + `$`
+		}
+
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid scope entry %q: %w", entry, err)
+		}
+		scope = append(scope, re)
+	}
+	return scope, nil
+}
+
+// inScope reports whether name is allowed by scope. An empty scope allows everything.
+func inScope(scope []*regexp.Regexp, name string) bool {
+	return len(scope) == 0 || matchesAny(scope, name)
+}
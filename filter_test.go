@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestIncludeExcludePrecedence(t *testing.T) {
+	entries := []CRTEntry{{ID: 1, NameValue: "api.example.com\ndev-api.example.com\nwww.example.com\ndev.example.com"}}
+	tests := []struct {
+		name             string
+		include, exclude string
+		want             []string
+	}{
+		{"no filters", "", "", []string{"api.example.com", "dev-api.example.com", "dev.example.com", "www.example.com"}},
+		{"include only", "*api*", "", []string{"api.example.com", "dev-api.example.com"}},
+		{"exclude only", "", "dev*", []string{"api.example.com", "www.example.com"}},
+		{"exclude wins over include", "*api*", "dev*", []string{"api.example.com"}},
+		{"any include pattern keeps a name", `*api*,re:^www\.`, "", []string{"api.example.com", "dev-api.example.com", "www.example.com"}},
+		{"exclude everything included", "*api*", "*api*", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			include, err := parsePatterns(tt.include)
+			if err != nil {
+				t.Fatal(err)
+			}
+			exclude, err := parsePatterns(tt.exclude)
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts := DefaultOptions()
+			opts.include, opts.exclude = include, exclude
+
+			scan := newDomainScan("example.com", nil, false)
+			scan.addEntries("example.com", entries, opts)
+			if got := scan.subs.Sorted(); !sameStrings(got, tt.want) {
+				t.Errorf("subs = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
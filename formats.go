@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Values of -format.
+const (
+	formatTxt  = "txt"  // subs.txt and the wildcard lists
+	formatJSON = "json" // results.json
+	formatCSV  = "csv"  // results.csv
+)
+
+// splitFormats splits the comma-separated -format value, dropping repeats.
+// Options.Validate reports unknown formats.
+func splitFormats(list string) []string {
+	var formats []string
+	seen := make(map[string]bool)
+	for _, f := range strings.Split(list, ",") {
+		f = strings.ToLower(strings.TrimSpace(f))
+		if f == "" || seen[f] {
+			continue
+		}
+		seen[f] = true
+		formats = append(formats, f)
+	}
+	return formats
+}
+
+func hasFormat(formats []string, format string) bool {
+	for _, f := range formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// resultsFile returns the name of the file written for format, other than txt.
+func resultsFile(format string) string {
+	return "results." + format
+}
+
+// domainResults is the content of results.json. Sources is only filled
+// with -with-source.
+type domainResults struct {
+	Domain     string        `json:"domain"`
+	Subdomains []string      `json:"subdomains"`
+	Wildcards  []string      `json:"wildcards"`
+	Sources    []sourcedName `json:"sources,omitempty"`
+}
+
+// writeResults writes the subdomains and wildcard roots of domain to name,
+// serialized as format (json or csv). Both come from the same collected sets
+// as subs.txt, so all formats agree. A non-nil sources adds the sources of
+// each subdomain, as in subs_sources.json.
+func writeResults(out outputBackend, name, format, domain string, subs, wildcards *StringSet, sources map[string]sourceMask, sortMode string) error {
+	res := domainResults{
+		Domain:     domain,
+		Subdomains: sortedSet(subs, sortMode),
+		Wildcards:  sortedSet(wildcards, sortMode),
+	}
+	if sources != nil {
+		res.Sources = make([]sourcedName, 0, len(res.Subdomains))
+		for _, n := range res.Subdomains {
+			res.Sources = append(res.Sources, sourcedName{Name: n, Sources: sources[n].names()})
+		}
+	}
+
+	var data []byte
+	switch format {
+	case formatJSON:
+		b, err := json.MarshalIndent(res, "", "  ")
+		if err != nil {
+			return err
+		}
+		data = append(b, '\n')
+	case formatCSV:
+		// One "name,type" row per hostname, subdomains first. With sources,
+		// a third column lists them separated by ";" (empty for wildcards).
+		var buf bytes.Buffer
+		w := csv.NewWriter(&buf)
+		if sources != nil {
+			w.Write([]string{"name", "type", "sources"})
+			for _, sn := range res.Sources {
+				w.Write([]string{sn.Name, "subdomain", strings.Join(sn.Sources, ";")})
+			}
+			for _, n := range res.Wildcards {
+				w.Write([]string{n, "wildcard", ""})
+			}
+		} else {
+			w.Write([]string{"name", "type"})
+			for _, n := range res.Subdomains {
+				w.Write([]string{n, "subdomain"})
+			}
+			for _, n := range res.Wildcards {
+				w.Write([]string{n, "wildcard"})
+			}
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return err
+		}
+		data = buf.Bytes()
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+	return out.WriteFile(name, data)
+}
+
+// mergeResults adds the subdomains and wildcard roots of an existing results
+// file, as written by writeResults, to subs and wildcards. -append uses it
+// when txt is not among the formats. A missing file is not an error.
+func mergeResults(out outputBackend, name, format string, subs, wildcards *StringSet) error {
+	data, err := out.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case formatJSON:
+		var res domainResults
+		if err := json.Unmarshal(data, &res); err != nil {
+			return err
+		}
+		for _, n := range res.Subdomains {
+			subs.Add(n)
+		}
+		for _, n := range res.Wildcards {
+			wildcards.Add(n)
+		}
+	case formatCSV:
+		r := csv.NewReader(bytes.NewReader(data))
+		r.FieldsPerRecord = -1 // the sources column is optional
+		rows, err := r.ReadAll()
+		if err != nil {
+			return err
+		}
+		for i, row := range rows {
+			if i == 0 || len(row) < 2 {
+				continue // header
+			}
+			switch row[1] {
+			case "subdomain":
+				subs.Add(row[0])
+			case "wildcard":
+				wildcards.Add(row[0])
+			}
+		}
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteResultsSources(t *testing.T) {
+	subs, wildcards := NewStringSet(), NewStringSet()
+	subs.Add("www.example.com")
+	subs.Add("api.example.com")
+	wildcards.Add("dev.example.com")
+	sources := map[string]sourceMask{"api.example.com": sourceCrtshAPI | sourceCrtshDB}
+
+	tests := []struct {
+		name    string
+		format  string
+		sources map[string]sourceMask
+		want    string
+	}{
+		{
+			name:   "csv without sources",
+			format: formatCSV,
+			want:   "name,type\napi.example.com,subdomain\nwww.example.com,subdomain\ndev.example.com,wildcard\n",
+		},
+		{
+			name:    "csv with sources",
+			format:  formatCSV,
+			sources: sources,
+			want:    "name,type,sources\napi.example.com,subdomain,crtsh;crtsh-db\nwww.example.com,subdomain,\ndev.example.com,wildcard,\n",
+		},
+		{
+			name:   "json without sources",
+			format: formatJSON,
+			want: `{
+  "domain": "example.com",
+  "subdomains": [
+    "api.example.com",
+    "www.example.com"
+  ],
+  "wildcards": [
+    "dev.example.com"
+  ]
+}
+`,
+		},
+		{
+			name:    "json with sources",
+			format:  formatJSON,
+			sources: sources,
+			want: `{
+  "domain": "example.com",
+  "subdomains": [
+    "api.example.com",
+    "www.example.com"
+  ],
+  "wildcards": [
+    "dev.example.com"
+  ],
+  "sources": [
+    {
+      "name": "api.example.com",
+      "sources": [
+        "crtsh",
+        "crtsh-db"
+      ]
+    },
+    {
+      "name": "www.example.com",
+      "sources": []
+    }
+  ]
+}
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), resultsFile(tt.format))
+			if err := writeResults(localBackend{}, path, tt.format, "example.com", subs, wildcards, tt.sources, sortLex); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(data); got != tt.want {
+				t.Errorf("%s =\n%s\nwant\n%s", resultsFile(tt.format), got, tt.want)
+			}
+		})
+	}
+}
+
+// -append without txt reads back what writeResults wrote, with or without
+// the sources of -with-source.
+func TestMergeResultsRoundTrip(t *testing.T) {
+	subs, wildcards := NewStringSet(), NewStringSet()
+	subs.Add("api.example.com")
+	subs.Add("www.example.com")
+	wildcards.Add("dev.example.com")
+
+	for _, format := range []string{formatJSON, formatCSV} {
+		for _, sources := range []map[string]sourceMask{nil, {"api.example.com": sourceCrtshAPI}} {
+			path := filepath.Join(t.TempDir(), resultsFile(format))
+			if err := writeResults(localBackend{}, path, format, "example.com", subs, wildcards, sources, sortLex); err != nil {
+				t.Fatal(err)
+			}
+
+			gotSubs, gotWildcards := NewStringSet(), NewStringSet()
+			gotSubs.Add("new.example.com")
+			if err := mergeResults(localBackend{}, path, format, gotSubs, gotWildcards); err != nil {
+				t.Fatalf("%s: %v", format, err)
+			}
+			if got, want := gotSubs.Sorted(), []string{"api.example.com", "new.example.com", "www.example.com"}; !sameStrings(got, want) {
+				t.Errorf("%s (sources %v): subs = %q, want %q", format, sources != nil, got, want)
+			}
+			if got, want := gotWildcards.Sorted(), []string{"dev.example.com"}; !sameStrings(got, want) {
+				t.Errorf("%s (sources %v): wildcards = %q, want %q", format, sources != nil, got, want)
+			}
+		}
+	}
+
+	// A missing file is not an error
+	if err := mergeResults(localBackend{}, filepath.Join(t.TempDir(), "results.json"), formatJSON, NewStringSet(), NewStringSet()); err != nil {
+		t.Errorf("missing file: %v", err)
+	}
+}
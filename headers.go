@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// headerFlag collects the repeatable -header "Name: Value" flag.
+type headerFlag struct {
+	header http.Header
+}
+
+func (f *headerFlag) String() string {
+	if f == nil || len(f.header) == 0 {
+		return ""
+	}
+	var lines []string
+	for name, values := range f.header {
+		for _, v := range values {
+			lines = append(lines, name+": "+v)
+		}
+	}
+	return strings.Join(lines, ", ")
+}
+
+func (f *headerFlag) Set(s string) error {
+	name, value, ok := strings.Cut(s, ":")
+	if !ok {
+		return fmt.Errorf("invalid header %q: must be \"Name: Value\"", s)
+	}
+	name = strings.TrimSpace(name)
+	value = strings.TrimSpace(value)
+	if !isHeaderToken(name) {
+		return fmt.Errorf("invalid header name %q", name)
+	}
+	if strings.ContainsAny(value, "\r\n\x00") {
+		return fmt.Errorf("invalid value for header %q", name)
+	}
+	if f.header == nil {
+		f.header = make(http.Header)
+	}
+	f.header.Add(name, value)
+	return nil
+}
+
+// repeatable marks -header as a repeatableFlag, so a config array adds one
+// header per element.
+func (f *headerFlag) repeatable() {}
+
+// isHeaderToken reports whether name is a valid HTTP header field name.
+func isHeaderToken(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// redactHeaderArgs returns a copy of the command line args with the value of
+// every -header replaced, so only the header names reach logs. The values
+// are often API keys or tokens.
+func redactHeaderArgs(args []string) []string {
+	out := make([]string, len(args))
+	copy(out, args)
+	for i := 0; i < len(out); i++ {
+		arg := out[i]
+		if arg == "--" {
+			break
+		}
+		flagName, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || flagName != "header" {
+			continue
+		}
+		if hasValue {
+			out[i] = arg[:len(arg)-len(value)] + redactHeader(value)
+		} else if i+1 < len(out) {
+			i++
+			out[i] = redactHeader(out[i])
+		}
+	}
+	return out
+}
+
+// redactHeader turns "Name: Value" into "Name: [redacted]".
+func redactHeader(h string) string {
+	name, _, _ := strings.Cut(h, ":")
+	return strings.TrimSpace(name) + ": [redacted]"
+}
+
+// headerTransport adds fixed headers to every request it sends, retries
+// included. A "Host" header replaces the request's host.
+type headerTransport struct {
+	base   http.RoundTripper
+	header http.Header
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for name, values := range t.header {
+		if name == "Host" {
+			req.Host = values[len(values)-1]
+			continue
+		}
+		req.Header[name] = values
+	}
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRedactHeaderArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{
+			name: "separate value",
+			args: []string{"crt_subfinder", "-header", "X-Api-Key: secret", "-rate", "2", "targets.txt"},
+			want: []string{"crt_subfinder", "-header", "X-Api-Key: [redacted]", "-rate", "2", "targets.txt"},
+		},
+		{
+			name: "inline value and double dash",
+			args: []string{"crt_subfinder", "-header=Authorization: Bearer abc", "--header", "X-B:2", "targets.txt"},
+			want: []string{"crt_subfinder", "-header=Authorization: [redacted]", "--header", "X-B: [redacted]", "targets.txt"},
+		},
+		{
+			name: "no headers",
+			args: []string{"crt_subfinder", "-workers", "5", "targets.txt"},
+			want: []string{"crt_subfinder", "-workers", "5", "targets.txt"},
+		},
+		{
+			name: "after the end of the flags",
+			args: []string{"crt_subfinder", "--", "-header", "targets.txt"},
+			want: []string{"crt_subfinder", "--", "-header", "targets.txt"},
+		},
+		{
+			name: "missing value",
+			args: []string{"crt_subfinder", "-header"},
+			want: []string{"crt_subfinder", "-header"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string(nil), tt.args...)
+			got := redactHeaderArgs(args)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("redactHeaderArgs() = %q, want %q", got, tt.want)
+			}
+			if !reflect.DeepEqual(args, tt.args) {
+				t.Errorf("args modified: %q", args)
+			}
+		})
+	}
+}
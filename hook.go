@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// completionHook runs the -on-complete command after each finished domain.
+// Commands run in the background, at most `parallel` at a time, so a slow
+// hook doesn't hold up the workers. A nil *completionHook does nothing.
+type completionHook struct {
+	template string
+	timeout  time.Duration
+	sem      chan struct{}
+	wg       sync.WaitGroup
+}
+
+func newCompletionHook(template string, timeout time.Duration, parallel int) *completionHook {
+	return &completionHook{
+		template: template,
+		timeout:  timeout,
+		sem:      make(chan struct{}, max(parallel, 1)),
+	}
+}
+
+// run starts the command for domain. Placeholders are replaced with
+// shell-quoted values: {domain}, {dir}, {subs_file} and {wildcards_file}.
+func (h *completionHook) run(domain, dir, subsFile, wildcardsFile string) {
+	if h == nil {
+		return
+	}
+	cmdline := strings.NewReplacer(
+		"{domain}", shellQuote(domain),
+		"{dir}", shellQuote(dir),
+		"{subs_file}", shellQuote(subsFile),
+		"{wildcards_file}", shellQuote(wildcardsFile),
+	).Replace(h.template)
+
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		h.sem <- struct{}{}
+		defer func() { <-h.sem }()
+
+		lf := logFields{Domain: domain}
+		ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+		defer cancel()
+
+		var stdout, stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, "sh", "-c", cmdline)
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		// Don't wait for background children that keep the output pipes open
+		cmd.WaitDelay = time.Second
+		err := cmd.Run()
+
+		for _, line := range strings.Split(strings.TrimSpace(stdout.String()), "\n") {
+			if line != "" {
+				logInfo(lf, "on-complete: %s", line)
+			}
+		}
+		for _, line := range strings.Split(strings.TrimSpace(stderr.String()), "\n") {
+			if line != "" {
+				logWarn(lf, "on-complete: %s", line)
+			}
+		}
+		switch {
+		case errors.Is(ctx.Err(), context.DeadlineExceeded):
+			logError(lf, "Error: -on-complete command for %s timed out after %s", domain, h.timeout)
+		case err != nil:
+			logError(lf, "Error: -on-complete command for %s failed: %v", domain, err)
+		}
+	}()
+}
+
+// wait blocks until all started commands have finished.
+func (h *completionHook) wait() {
+	if h == nil {
+		return
+	}
+	h.wg.Wait()
+}
+
+// shellQuote quotes s for use as a single word in a POSIX shell command.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// toASCII converts an internationalized domain name to its ASCII (punycode)
+// form, so that "münchen.example.com" and "xn--mnchen-3ya.example.com" are
+// stored as the same name. Non-ASCII labels go through UTS #46 mapping and
+// NFC normalization, so decomposed and precomposed spellings collapse as
+// well. Labels are converted one at a time, because crt.sh names contain
+// labels such as "*" and "_dmarc" that IDNA rejects; ASCII labels are only
+// lowercased, and labels that cannot be converted are left unchanged.
+func toASCII(name string) string {
+	labels := strings.Split(name, ".")
+	for i, label := range labels {
+		if isASCII(label) {
+			labels[i] = strings.ToLower(label)
+			continue
+		}
+		encoded, err := idna.Lookup.ToASCII(label)
+		if err != nil {
+			labels[i] = strings.ToLower(label)
+			continue
+		}
+		labels[i] = encoded
+	}
+	return strings.Join(labels, ".")
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
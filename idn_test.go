@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestToASCII(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"münchen.example.com", "xn--mnchen-3ya.example.com"},
+		{"xn--mnchen-3ya.example.com", "xn--mnchen-3ya.example.com"},
+		{"MÜNCHEN.Example.COM", "xn--mnchen-3ya.example.com"},
+		{"XN--MNCHEN-3YA.example.com", "xn--mnchen-3ya.example.com"},
+		{"bücher.xn--mnchen-3ya.de", "xn--bcher-kva.xn--mnchen-3ya.de"},
+		{"*.münchen.de", "*.xn--mnchen-3ya.de"},
+		{"mu\u0308nchen.example.com", "xn--mnchen-3ya.example.com"}, // decomposed ü
+		{"_dmarc.münchen.de", "_dmarc.xn--mnchen-3ya.de"},
+		{"straße.de", "xn--strae-oqa.de"},
+		{"www.example.com", "www.example.com"},
+	}
+	for _, tt := range tests {
+		if got := toASCII(tt.in); got != tt.want {
+			t.Errorf("toASCII(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+// Both spellings crt.sh uses for the same name must end up as one entry.
+func TestAddEntriesMergesIDNSpellings(t *testing.T) {
+	scan := newDomainScan("example.com", nil, false)
+	scan.addEntries("example.com", []CRTEntry{
+		{ID: 1, NameValue: "münchen.example.com"},
+		{ID: 2, NameValue: "xn--mnchen-3ya.example.com"},
+		{ID: 3, NameValue: "MÜNCHEN.example.com"},
+		{ID: 4, NameValue: "mu\u0308nchen.example.com"},
+	}, DefaultOptions())
+
+	if got := scan.subs.Sorted(); !sameStrings(got, []string{"xn--mnchen-3ya.example.com"}) {
+		t.Errorf("subs = %q, want one punycode entry", got)
+	}
+}
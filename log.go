@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Diagnostic output. Human-readable lines carry the usual "[*]", "[+]" and
+// "[!]" markers; with -json-logs every line is a single JSON object instead.
+
+type logLevel int
+
+const (
+	levelInfo logLevel = iota
+	levelSuccess
+	levelWarn
+	levelError
+)
+
+var (
+	levelNames   = [...]string{"info", "info", "warn", "error"}
+	levelMarkers = [...]string{"[*] ", "[+] ", "[!] ", ""}
+)
+
+// logFields is the optional structured context of a log line. Lines that
+// concern a single crt.sh query set Query and are indented in human output.
+// Event tags lines that scripts are expected to look for.
+type logFields struct {
+	Domain  string
+	Query   string
+	Attempt int
+	Status  int
+	Event   string
+}
+
+// Values of logFields.Event.
+const (
+	eventLowResults = "low_results"
+)
+
+type jsonLogLine struct {
+	TS      string `json:"ts"`
+	Level   string `json:"level"`
+	Msg     string `json:"msg"`
+	Domain  string `json:"domain,omitempty"`
+	Query   string `json:"query,omitempty"`
+	Attempt int    `json:"attempt,omitempty"`
+	Status  int    `json:"status,omitempty"`
+	Event   string `json:"event,omitempty"`
+}
+
+// logOut receives diagnostic output and errOut receives errors. logOut is
+// stdout by default and stderr when results are printed to stdout (-stream,
+// -count-only), so that stdout carries nothing but results.
+var (
+	logOut   io.Writer = os.Stdout
+	errOut   io.Writer = os.Stderr
+	jsonLogs bool
+	outMu    sync.Mutex
+
+	// quietAttempts hides failed attempts that may still be retried (-quiet-errors)
+	quietAttempts bool
+
+	// silent hides info and success lines on the console (-silent)
+	silent bool
+
+	// logFile receives a copy of all diagnostic output (-log-file). Human
+	// lines are prefixed with a timestamp there.
+	logFile io.Writer
+)
+
+func logAt(level logLevel, f logFields, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+
+	w := logOut
+	if level == levelError {
+		w = errOut
+	}
+
+	outMu.Lock()
+	defer outMu.Unlock()
+
+	// The log file still gets everything
+	console := !silent || level >= levelWarn
+
+	if jsonLogs {
+		data, err := json.Marshal(jsonLogLine{
+			TS:      time.Now().UTC().Format(time.RFC3339Nano),
+			Level:   levelNames[level],
+			Msg:     msg,
+			Domain:  f.Domain,
+			Query:   f.Query,
+			Attempt: f.Attempt,
+			Status:  f.Status,
+			Event:   f.Event,
+		})
+		if err == nil {
+			if console {
+				w.Write(append(data, '\n'))
+			}
+			if logFile != nil {
+				logFile.Write(append(data, '\n'))
+			}
+		}
+		return
+	}
+
+	indent := ""
+	if f.Query != "" {
+		indent = "    "
+	}
+	if console {
+		progress.clear()
+		fmt.Fprintf(w, "%s%s%s\n", indent, levelMarkers[level], msg)
+		progress.draw()
+	}
+	if logFile != nil {
+		fmt.Fprintf(logFile, "%s %s%s%s\n", time.Now().UTC().Format(time.RFC3339), indent, levelMarkers[level], msg)
+	}
+}
+
+func logInfo(f logFields, format string, args ...interface{}) {
+	logAt(levelInfo, f, format, args...)
+}
+
+func logSuccess(f logFields, format string, args ...interface{}) {
+	logAt(levelSuccess, f, format, args...)
+}
+
+func logWarn(f logFields, format string, args ...interface{}) {
+	logAt(levelWarn, f, format, args...)
+}
+
+func logError(f logFields, format string, args ...interface{}) {
+	logAt(levelError, f, format, args...)
+}
+
+// logAttemptFailure logs a failed request attempt as a warning, unless
+// -quiet-errors is set.
+func logAttemptFailure(f logFields, format string, args ...interface{}) {
+	if quietAttempts {
+		return
+	}
+	logAt(levelWarn, f, format, args...)
+}
+
+// logBreak prints the blank line that separates domains in human output.
+func logBreak() {
+	if jsonLogs || silent {
+		return
+	}
+	outMu.Lock()
+	defer outMu.Unlock()
+	progress.clear()
+	fmt.Fprintln(logOut)
+	progress.draw()
+}
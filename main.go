@@ -1,311 +1,2052 @@
-package main
-
-import (
-	"bufio"
-	"encoding/json"
-	"flag"
-	"fmt"
-	"io"
-	"net/http"
-	"os"
-	"path/filepath"
-	"sort"
-	"strings"
-	"sync"
-	"time"
-)
-
-type CRTEntry struct {
-	NameValue string `json:"name_value"`
-}
-
-func trimSpaces(s string) string {
-	return strings.TrimSpace(s)
-}
-
-func isCommentOrEmpty(line string) bool {
-	line = strings.TrimSpace(line)
-	return line == "" || strings.HasPrefix(line, "#")
-}
-
-// fetchCrtForDomain queries crt.sh for a given domain, extracts subdomains and wildcard roots,
-// and enqueues new wildcard roots for further processing.
-func fetchCrtForDomain(
-	client *http.Client,
-	current string,
-	rateLimit time.Duration,
-	maxRetries int,
-	subsSet map[string]struct{},
-	wildcardsSet map[string]struct{},
-	seen map[string]struct{},
-	queue *[]string,
-) {
-	fmt.Printf("    [*] Querying crt.sh for *.%s\n", current)
-
-	url := fmt.Sprintf("https://crt.sh/?q=%%25.%s&output=json", current)
-
-	var lastStatus int
-	var body []byte
-	var err error
-
-	for attempt := 1; attempt <= maxRetries; attempt++ {
-		var resp *http.Response
-		resp, err = client.Get(url)
-		if err != nil {
-			fmt.Printf("    [!] Error requesting %s (attempt %d/%d): %v\n", current, attempt, maxRetries, err)
-		} else {
-			lastStatus = resp.StatusCode
-			body, err = io.ReadAll(resp.Body)
-			resp.Body.Close()
-			if err != nil {
-				fmt.Printf("    [!] Error reading response for %s (attempt %d/%d): %v\n", current, attempt, maxRetries, err)
-			} else if resp.StatusCode == http.StatusOK {
-				break
-			} else {
-				fmt.Printf("    [!] HTTP %d for %s (attempt %d/%d)\n", resp.StatusCode, current, attempt, maxRetries)
-			}
-		}
-		time.Sleep(rateLimit)
-	}
-
-	if err != nil || lastStatus != http.StatusOK {
-		fmt.Printf("    [!] Giving up on %s\n", current)
-		return
-	}
-
-	// Parse JSON; crt.sh sometimes returns "[]" when no results
-	var entries []CRTEntry
-	if err := json.Unmarshal(body, &entries); err != nil {
-		fmt.Printf("    [!] Invalid JSON from crt.sh for %s (skipping): %v\n", current, err)
-		return
-	}
-
-	if len(entries) == 0 {
-		fmt.Printf("    [*] No results for %s\n", current)
-		return
-	}
-
-	// Deduplicate name values
-	namesSeen := make(map[string]struct{})
-
-	for _, e := range entries {
-		if e.NameValue == "" {
-			continue
-		}
-		// name_value can contain multiple lines (multiple CNs)
-		for _, raw := range strings.Split(e.NameValue, "\n") {
-			name := strings.TrimSpace(strings.Trim(raw, "\r"))
-			if name == "" {
-				continue
-			}
-			if _, ok := namesSeen[name]; ok {
-				continue
-			}
-			namesSeen[name] = struct{}{}
-
-			if strings.HasPrefix(name, "*.") {
-				// Clean wildcard: "*.ae.aliexpress.com" -> "ae.aliexpress.com"
-				clean := strings.TrimPrefix(name, "*.")
-				if clean == "" {
-					continue
-				}
-				// Store wildcard root
-				if _, ok := wildcardsSet[clean]; !ok {
-					wildcardsSet[clean] = struct{}{}
-				}
-				// Enqueue for further processing if not already seen
-				if _, ok := seen[clean]; !ok {
-					*queue = append(*queue, clean)
-				}
-			} else {
-				// Normal subdomain
-				if _, ok := subsSet[name]; !ok {
-					subsSet[name] = struct{}{}
-				}
-			}
-		}
-	}
-
-	time.Sleep(rateLimit)
-}
-
-func processDomain(
-	domain string,
-	client *http.Client,
-	rateLimit time.Duration,
-	maxRetries int,
-	skipDone bool,
-) error {
-	fmt.Printf("[+] Processing %s\n", domain)
-
-	// Make directory for this domain
-	if err := os.MkdirAll(domain, 0o755); err != nil {
-		return fmt.Errorf("failed to create directory '%s': %w", domain, err)
-	}
-
-	subsPath := filepath.Join(domain, "subs.txt")
-	wildcardsPath := filepath.Join(domain, "wildcards_clean.txt")
-
-	// If skipDone is enabled and subs.txt exists and is non-empty, skip
-	if skipDone {
-		if info, err := os.Stat(subsPath); err == nil && info.Size() > 0 {
-			fmt.Printf("[*] Skipping %s (subs.txt already exists)\n\n", domain)
-			return nil
-		}
-	}
-
-	// Sets for deduplication
-	subsSet := make(map[string]struct{})
-	wildcardsSet := make(map[string]struct{})
-
-	seen := make(map[string]struct{})
-	queue := []string{domain}
-
-	for len(queue) > 0 {
-		current := queue[0]
-		queue = queue[1:]
-
-		if _, ok := seen[current]; ok {
-			continue
-		}
-		seen[current] = struct{}{}
-
-		fetchCrtForDomain(
-			client,
-			current,
-			rateLimit,
-			maxRetries,
-			subsSet,
-			wildcardsSet,
-			seen,
-			&queue,
-		)
-	}
-
-	// Write subs.txt (sorted, unique)
-	if err := writeSetSorted(subsPath, subsSet); err != nil {
-		return fmt.Errorf("failed to write subs.txt for %s: %w", domain, err)
-	}
-
-	// Write wildcards_clean.txt (sorted, unique)
-	if err := writeSetSorted(wildcardsPath, wildcardsSet); err != nil {
-		return fmt.Errorf("failed to write wildcards_clean.txt for %s: %w", domain, err)
-	}
-
-	fmt.Printf("[+] Done → %s/\n\n", domain)
-	return nil
-}
-
-func writeSetSorted(path string, set map[string]struct{}) error {
-	f, err := os.Create(path)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	var items []string
-	for k := range set {
-		items = append(items, k)
-	}
-	sort.Strings(items)
-
-	for _, v := range items {
-		if _, err := fmt.Fprintln(f, v); err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-func main() {
-	// Flags
-	rateLimitSec := flag.Int("rate", 1, "delay in seconds between crt.sh requests")
-	maxRetries := flag.Int("retries", 3, "maximum retry attempts for each request")
-	skipDone := flag.Bool("skip-done", true, "skip domains where subs.txt already exists and is non-empty")
-	workers := flag.Int("workers", 1, "number of concurrent workers (1 = no concurrency)")
-	timeoutSec := flag.Int("timeout", 20, "HTTP client timeout in seconds")
-
-	flag.Parse()
-
-	// Input file: first non-flag arg or default "domains.txt"
-	inputFile := "domains.txt"
-	if flag.NArg() > 0 {
-		inputFile = flag.Arg(0)
-	}
-
-	// Check input file exists
-	if _, err := os.Stat(inputFile); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: input file '%s' not found.\n", inputFile)
-		os.Exit(1)
-	}
-
-	rateLimit := time.Duration(*rateLimitSec) * time.Second
-
-	client := &http.Client{
-		Timeout: time.Duration(*timeoutSec) * time.Second,
-	}
-
-	// Read domains first
-	f, err := os.Open(inputFile)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: could not open '%s': %v\n", inputFile, err)
-		os.Exit(1)
-	}
-	defer f.Close()
-
-	var domains []string
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if isCommentOrEmpty(line) {
-			continue
-		}
-		domain := trimSpaces(line)
-		if domain == "" {
-			continue
-		}
-		domains = append(domains, domain)
-	}
-	if err := scanner.Err(); err != nil {
-		fmt.Fprintf(os.Stderr, "Error reading '%s': %v\n", inputFile, err)
-	}
-
-	if len(domains) == 0 {
-		fmt.Println("No domains to process.")
-		return
-	}
-
-	// If workers <= 1, run sequentially
-	if *workers <= 1 {
-		for _, domain := range domains {
-			if err := processDomain(domain, client, rateLimit, *maxRetries, *skipDone); err != nil {
-				fmt.Fprintf(os.Stderr, "Error processing %s: %v\n", domain, err)
-			}
-		}
-		return
-	}
-
-	// Concurrent processing with a worker pool
-	fmt.Printf("Using %d workers\n", *workers)
-
-	domainCh := make(chan string)
-	var wg sync.WaitGroup
-
-	for i := 0; i < *workers; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for domain := range domainCh {
-				if err := processDomain(domain, client, rateLimit, *maxRetries, *skipDone); err != nil {
-					fmt.Fprintf(os.Stderr, "Error processing %s: %v\n", domain, err)
-				}
-			}
-		}()
-	}
-
-	for _, d := range domains {
-		domainCh <- d
-	}
-	close(domainCh)
-	wg.Wait()
-}
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Build metadata, injected at build time with
+//
+//	go build -ldflags "-X main.version=v1.2.0 -X main.commit=$(git rev-parse --short HEAD) -X main.date=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	version = "dev"
+	commit  = "none"
+	date    = "unknown"
+)
+
+// print0 ends results on stdout with NUL instead of a newline (-print0).
+var print0 bool
+
+// emitResult writes a result line (a streamed subdomain, a count) to stdout.
+func emitResult(line string) {
+	end := "\n"
+	if print0 {
+		end = "\x00"
+	}
+	outMu.Lock()
+	defer outMu.Unlock()
+	progress.clear()
+	fmt.Fprint(os.Stdout, line+end)
+	progress.draw()
+}
+
+type CRTEntry struct {
+	ID         int64  `json:"id"`
+	IssuerName string `json:"issuer_name"`
+	NameValue  string `json:"name_value"`
+	CommonName string `json:"common_name"`
+	NotBefore  string `json:"not_before"`
+	NotAfter   string `json:"not_after"`
+}
+
+// names returns the raw hostnames on the certificate: the entries of
+// name_value and, if withCommonName is set, the subject common name. The CN
+// is usually among the SANs too, but not always; it is skipped unless it
+// looks like a hostname, since CNs can also be person or company names.
+func (e CRTEntry) names(withCommonName bool) []string {
+	// name_value lists one name per line; some mirrors separate them with
+	// commas instead, so both are accepted. Tokens are trimmed by the caller.
+	names := strings.FieldsFunc(e.NameValue, func(r rune) bool {
+		return r == '\n' || r == ','
+	})
+	if withCommonName && e.CommonName != "" {
+		cn := normalizeDomain(e.CommonName)
+		if isValidDomain(strings.TrimPrefix(cn, "*.")) {
+			names = append(names, e.CommonName)
+		}
+	}
+	return names
+}
+
+// CertDetails is the certificate information kept per subdomain when
+// -with-cert-details is enabled.
+type CertDetails struct {
+	Name       string `json:"name"`
+	ID         int64  `json:"id"`
+	IssuerName string `json:"issuer_name"`
+	NotBefore  string `json:"not_before"`
+	NotAfter   string `json:"not_after"`
+}
+
+// newerThan reports whether e was issued after d. crt.sh timestamps are
+// ISO 8601, so they compare correctly as strings; the certificate ID breaks ties.
+func (e CRTEntry) newerThan(d CertDetails) bool {
+	if e.NotBefore != d.NotBefore {
+		return e.NotBefore > d.NotBefore
+	}
+	return e.ID > d.ID
+}
+
+func trimSpaces(s string) string {
+	return strings.TrimSpace(s)
+}
+
+func isCommentOrEmpty(line string) bool {
+	line = strings.TrimSpace(line)
+	return line == "" || strings.HasPrefix(line, "#")
+}
+
+// readNameFile reads a one-name-per-line file such as the input list or a
+// previous subs.txt, skipping comments and blank lines. Anything after the
+// first whitespace on a line is ignored, so a -failures file can be read too.
+func readNameFile(path string) ([]string, error) {
+	r, err := openNameFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	names, err := parseNames(r)
+	if err != nil {
+		return nil, fmt.Errorf("error reading '%s': %w", path, err)
+	}
+	return names, nil
+}
+
+// streamNameFiles calls fn with each name in the files at paths, in order,
+// without holding them in memory (-stream-input). It stops when fn returns
+// false.
+func streamNameFiles(paths []string, fn func(name string) bool) error {
+	more := true
+	for _, path := range paths {
+		r, err := openNameFile(path)
+		if err != nil {
+			return err
+		}
+		err = scanNames(r, func(name string) bool {
+			more = fn(name)
+			return more
+		})
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("error reading '%s': %w", path, err)
+		}
+		if !more {
+			return nil
+		}
+	}
+	return nil
+}
+
+// openNameFile opens path for reading. Files written with -gzip (ending in
+// .gz) are decompressed on the fly.
+func openNameFile(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open '%s': %w", path, err)
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return f, nil
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error reading '%s': %w", path, err)
+	}
+	return gzipFile{Reader: zr, f: f}, nil
+}
+
+// gzipFile closes both the gzip stream and the file under it.
+type gzipFile struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (g gzipFile) Close() error {
+	g.Reader.Close()
+	return g.f.Close()
+}
+
+func parseNames(r io.Reader) ([]string, error) {
+	var names []string
+	err := scanNames(r, func(name string) bool {
+		names = append(names, name)
+		return true
+	})
+	return names, err
+}
+
+// scanNames calls fn with the name on each line of r, skipping comments and
+// blank lines, until fn returns false.
+func scanNames(r io.Reader, fn func(name string) bool) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if isCommentOrEmpty(line) {
+			continue
+		}
+		if !fn(strings.Fields(line)[0]) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+// resultCounts accumulates the totals reported by -count-only.
+type resultCounts struct {
+	mu        sync.Mutex
+	domains   int
+	subs      int
+	wildcards int
+}
+
+func (c *resultCounts) add(subs, wildcards int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.domains++
+	c.subs += subs
+	c.wildcards += wildcards
+}
+
+// normalizeDomain lowercases a domain, converts it to punycode and strips a
+// trailing dot, so that "Example.com." and "example.com" refer to the same target.
+func normalizeDomain(d string) string {
+	return toASCII(trimTrailingDot(trimSpaces(d)))
+}
+
+// trimTrailingDot turns a fully-qualified "example.com." into "example.com".
+// Only one dot is removed, and a name that is just "." is left alone rather
+// than becoming empty.
+func trimTrailingDot(name string) string {
+	if len(name) > 1 && strings.HasSuffix(name, ".") {
+		return name[:len(name)-1]
+	}
+	return name
+}
+
+// urlHost returns the host of line if it is a URL such as
+// "https://app.example.com:8443/path", without the port. Anything else,
+// including a plain domain, is returned unchanged.
+func urlHost(line string) string {
+	if !strings.Contains(line, "://") {
+		return line
+	}
+	u, err := url.Parse(trimSpaces(line))
+	if err != nil || u.Host == "" {
+		return line
+	}
+	return u.Hostname()
+}
+
+// isValidDomain reports whether d is a syntactically valid hostname.
+func isValidDomain(d string) bool {
+	if d == "" || len(d) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(d, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			switch {
+			case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '_':
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isSubdomainOf reports whether name is domain itself or a name below it.
+func isSubdomainOf(name, domain string) bool {
+	name = strings.ToLower(name)
+	return name == domain || strings.HasSuffix(name, "."+domain)
+}
+
+// externalWildcards returns the wildcard roots that are not subordinate to
+// domain, i.e. zones the recursion reached through certificates that also
+// covered unrelated names.
+func externalWildcards(domain string, wildcards *StringSet) *StringSet {
+	external := NewStringSet()
+	for _, w := range wildcards.Sorted() {
+		if !isSubdomainOf(w, domain) {
+			external.Add(w)
+		}
+	}
+	return external
+}
+
+// collapseWildcards returns the wildcard roots that are not below another root
+// in the same set, e.g. it drops "a.example.com" when "example.com" is present.
+func collapseWildcards(wildcards *StringSet) *StringSet {
+	collapsed := NewStringSet()
+	for _, w := range wildcards.Sorted() {
+		covered := false
+		for parent := w; ; {
+			i := strings.IndexByte(parent, '.')
+			if i < 0 {
+				break
+			}
+			parent = parent[i+1:]
+			if wildcards.Contains(parent) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			collapsed.Add(w)
+		}
+	}
+	return collapsed
+}
+
+// trimWWW returns subs without the "www.X" names whose X is in subs too. A
+// "www.X" is kept when X itself was not found, since it is the only known host.
+func trimWWW(subs *StringSet) *StringSet {
+	trimmed := NewStringSet()
+	for _, s := range subs.Sorted() {
+		if rest, ok := strings.CutPrefix(s, "www."); ok && subs.Contains(rest) {
+			continue
+		}
+		trimmed.Add(s)
+	}
+	return trimmed
+}
+
+// prepareDomains normalizes the input list, strips leading "*." labels, drops
+// invalid entries with a warning and removes duplicates while keeping the
+// original order.
+func prepareDomains(raw []string) (domains []string, duplicates, invalid int) {
+	seen := make(map[string]struct{}, len(raw))
+	for _, line := range raw {
+		domain := normalizeDomain(line)
+		// "*.example.com" is a common copy-paste from scope documents
+		if strings.HasPrefix(domain, "*.") {
+			domain = strings.TrimPrefix(domain, "*.")
+			logInfo(logFields{}, "Treating %q as %s", trimSpaces(line), domain)
+		}
+		if !isValidDomain(domain) {
+			logWarn(logFields{}, "Skipping invalid domain %q", line)
+			invalid++
+			continue
+		}
+		if _, ok := seen[domain]; ok {
+			duplicates++
+			continue
+		}
+		seen[domain] = struct{}{}
+		domains = append(domains, domain)
+	}
+	return domains, duplicates, invalid
+}
+
+// domainScan holds the state collected while enumerating one input domain.
+// The sets are safe for concurrent use on their own; mu guards the remaining
+// fields, since several workers may drain the queue.
+type domainScan struct {
+	domain    string
+	mu        sync.Mutex
+	cond      *sync.Cond
+	active    int // queries currently in flight
+	subs      *StringSet
+	wildcards *StringSet
+	seen      *StringSet
+	queue     []string
+	certs     map[string]CertDetails // nil unless -with-cert-details is set
+	seeds     *StringSet             // the names the queue started with
+	sinceID   int64                  // entries with IDs up to this are ignored (-since-id-file)
+	maxID     int64                  // highest certificate ID seen, at least sinceID
+	seedErr   error                  // last failed seed query
+	failed    []string               // seeds whose query failed
+	depth     map[string]int         // recursion depth of each queued root; seeds are 0
+	sources   map[string]sourceMask  // nil unless -with-source is set
+	streamed  []string               // subdomains printed by -stream, kept with -first-n
+}
+
+// newDomainScan starts a scan from seeds, or from domain itself if there are none.
+func newDomainScan(domain string, seeds []string, withCertDetails bool) *domainScan {
+	if len(seeds) == 0 {
+		seeds = []string{domain}
+	}
+	scan := &domainScan{
+		domain:    domain,
+		subs:      NewStringSet(),
+		wildcards: NewStringSet(),
+		seen:      NewStringSet(),
+		queue:     append([]string(nil), seeds...),
+		seeds:     NewStringSet(),
+		depth:     make(map[string]int),
+	}
+	for _, s := range seeds {
+		scan.seeds.Add(s)
+	}
+	scan.cond = sync.NewCond(&scan.mu)
+	if withCertDetails {
+		scan.certs = make(map[string]CertDetails)
+	}
+	return scan
+}
+
+// next pops the next unseen name from the queue. While the queue is empty but
+// other queries are still in flight it waits, since they may enqueue more
+// roots. It returns false once all work for the domain is finished.
+func (scan *domainScan) next() (string, bool) {
+	scan.mu.Lock()
+	defer scan.mu.Unlock()
+
+	for {
+		for len(scan.queue) > 0 {
+			current := scan.queue[0]
+			scan.queue = scan.queue[1:]
+
+			if !scan.seen.Add(current) {
+				continue
+			}
+			scan.active++
+			return current, true
+		}
+		if scan.active == 0 {
+			return "", false
+		}
+		scan.cond.Wait()
+	}
+}
+
+// done marks a query returned by next as finished.
+func (scan *domainScan) done() {
+	scan.mu.Lock()
+	scan.active--
+	scan.mu.Unlock()
+	scan.cond.Broadcast()
+}
+
+// queryCache shares crt.sh results between all domains of a run, so that the
+// same query is issued at most once even when several input domains (or
+// concurrent workers) lead to it.
+type queryCache struct {
+	mu      sync.Mutex
+	results map[string]*cachedQuery
+}
+
+type cachedQuery struct {
+	done    chan struct{}
+	entries []CRTEntry
+	err     error
+}
+
+func newQueryCache() *queryCache {
+	return &queryCache{results: make(map[string]*cachedQuery)}
+}
+
+// get returns the cached result for name, calling fetch if nobody has queried
+// it yet. Concurrent callers for the same name wait for the first one. Failed
+// queries are not kept, so a later caller may try again. hit reports whether
+// the result came from an earlier query.
+func (c *queryCache) get(name string, fetch func() ([]CRTEntry, error)) (entries []CRTEntry, hit bool, err error) {
+	key := strings.ToLower(strings.TrimSuffix(name, "."))
+
+	c.mu.Lock()
+	if q, ok := c.results[key]; ok {
+		c.mu.Unlock()
+		<-q.done
+		return q.entries, true, q.err
+	}
+	q := &cachedQuery{done: make(chan struct{})}
+	c.results[key] = q
+	c.mu.Unlock()
+
+	q.entries, q.err = fetch()
+	if q.err != nil {
+		c.mu.Lock()
+		delete(c.results, key)
+		c.mu.Unlock()
+	}
+	close(q.done)
+	return q.entries, false, q.err
+}
+
+var errHTMLResponse = errors.New("crt.sh returned an HTML page instead of JSON")
+
+// isHTMLResponse reports whether a response is an HTML error or maintenance
+// page rather than the JSON API output.
+func isHTMLResponse(contentType string, body []byte) bool {
+	if strings.Contains(strings.ToLower(contentType), "html") {
+		return true
+	}
+	return bytes.HasPrefix(bytes.TrimSpace(body), []byte("<"))
+}
+
+// retryBudget caps the total number of retries across the whole run, so a
+// failing crt.sh is not hammered by every query retrying on its own. A nil
+// budget is unlimited.
+type retryBudget struct {
+	remaining atomic.Int64
+}
+
+func newRetryBudget(n int) *retryBudget {
+	if n <= 0 {
+		return nil
+	}
+	b := &retryBudget{}
+	b.remaining.Store(int64(n))
+	return b
+}
+
+// take consumes one retry and reports whether it was available.
+func (b *retryBudget) take() bool {
+	if b == nil {
+		return true
+	}
+	return b.remaining.Add(-1) >= 0
+}
+
+// sleepCtx sleeps for d or until ctx is cancelled, whichever comes first.
+func sleepCtx(ctx context.Context, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
+
+// Query modes selected with -query-mode.
+const (
+	queryModeWildcard = "wildcard" // q=%.name: certificates for names below name
+	queryModeExact    = "exact"    // q=name: certificates for name itself
+	queryModeBoth     = "both"
+)
+
+// crtQueries returns the crt.sh search terms to issue for name.
+func crtQueries(name, mode string) []string {
+	switch mode {
+	case queryModeExact:
+		return []string{name}
+	case queryModeBoth:
+		return []string{"%." + name, name}
+	default:
+		return []string{"%." + name}
+	}
+}
+
+// queryCrt queries crt.sh (or the mirror at opts.baseURL) for the search term
+// q with retries and decodes the response. It returns an error with the last
+// failure if the request could not be completed.
+func queryCrt(
+	ctx context.Context,
+	opts *Options,
+	domain string,
+	current string,
+	param, q string,
+) ([]CRTEntry, error) {
+	lf := logFields{Domain: domain, Query: current}
+	if param == "q" {
+		logInfo(lf, "Querying crt.sh for %s", strings.Replace(q, "%.", "*.", 1))
+	} else {
+		logInfo(lf, "Querying crt.sh for %s=%s", param, q)
+	}
+
+	reqURL := strings.TrimSuffix(opts.baseURL, "/") + "/?" + param + "=" + url.QueryEscape(q) + "&output=json"
+	if opts.excludeExpired {
+		// Same JSON shape, restricted to certificates that are still valid
+		reqURL += "&exclude=expired"
+	}
+
+	var lastStatus int
+	var body []byte
+	var err error
+	var truncated []byte // longest 200 body that was cut off mid-transfer
+	var lastFailure string
+
+	metrics.queries.Add(1)
+	for attempt := 1; attempt <= opts.maxRetries; attempt++ {
+		if attempt > 1 {
+			metrics.retries.Add(1)
+		}
+		var req *http.Request
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+		if err != nil {
+			lastFailure = err.Error()
+			break
+		}
+
+		var release func(status int)
+		release, err = opts.limiter.acquire(ctx, req.URL.Hostname())
+		if err != nil {
+			return nil, err
+		}
+
+		var resp *http.Response
+		resp, err = opts.client.Do(req)
+		if ctx.Err() != nil {
+			// The run was cancelled; there is nothing to retry
+			release(0)
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			release(0)
+			metrics.requestErrors.Add(1)
+			lastFailure = err.Error()
+			logAttemptFailure(logFields{Domain: domain, Query: current, Attempt: attempt}, "Error requesting %s (attempt %d/%d): %v", current, attempt, opts.maxRetries, err)
+		} else {
+			lastStatus = resp.StatusCode
+			metrics.observeStatus(resp.StatusCode)
+			body, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+			// Failed reads and HTML error pages mean crt.sh is struggling,
+			// just like 429 and 5xx responses
+			switch {
+			case err != nil:
+				release(0)
+			case resp.StatusCode == http.StatusOK && isHTMLResponse(resp.Header.Get("Content-Type"), body):
+				release(http.StatusServiceUnavailable)
+			default:
+				release(resp.StatusCode)
+			}
+			if err != nil {
+				if resp.StatusCode == http.StatusOK && len(body) > len(truncated) {
+					truncated = body
+				}
+				lastFailure = err.Error()
+				logAttemptFailure(logFields{Domain: domain, Query: current, Attempt: attempt, Status: resp.StatusCode}, "Error reading response for %s (attempt %d/%d): %v", current, attempt, opts.maxRetries, err)
+			} else if resp.StatusCode == http.StatusOK {
+				if !isHTMLResponse(resp.Header.Get("Content-Type"), body) {
+					break
+				}
+				// crt.sh serves error pages with status 200 when overloaded
+				err = errHTMLResponse
+				lastFailure = err.Error()
+				logAttemptFailure(logFields{Domain: domain, Query: current, Attempt: attempt, Status: resp.StatusCode}, "crt.sh returned an HTML page instead of JSON for %s (attempt %d/%d)", current, attempt, opts.maxRetries)
+			} else {
+				lastFailure = fmt.Sprintf("HTTP %d", resp.StatusCode)
+				logAttemptFailure(logFields{Domain: domain, Query: current, Attempt: attempt, Status: resp.StatusCode}, "HTTP %d for %s (attempt %d/%d)", resp.StatusCode, current, attempt, opts.maxRetries)
+			}
+		}
+		if attempt < opts.maxRetries && !opts.retryBudget.take() {
+			logWarn(lf, "Retry budget exhausted; not retrying %s", current)
+			break
+		}
+		sleepCtx(ctx, opts.rateLimit)
+	}
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil || lastStatus != http.StatusOK {
+		if len(truncated) == 0 {
+			logWarn(lf, "Giving up on %s (last error: %s)", current, lastFailure)
+			return nil, errors.New(lastFailure)
+		}
+		// Partial data beats none; decode whatever arrived
+		body = truncated
+	}
+	defer sleepCtx(ctx, opts.rateLimit)
+
+	// Parse JSON; crt.sh sometimes returns "[]" when no results
+	entries, err := decodeEntries(body)
+	if err != nil {
+		if len(entries) == 0 {
+			logWarn(lf, "Invalid JSON from crt.sh for %s (skipping): %v", current, err)
+			return nil, fmt.Errorf("invalid JSON from crt.sh: %w", err)
+		}
+		logWarn(lf, "Truncated response from crt.sh for %s; keeping the %d entries before the error: %v", current, len(entries), err)
+	}
+	return entries, nil
+}
+
+// decodeEntries decodes a crt.sh JSON array one entry at a time. If the body
+// is cut off or malformed part way, the entries decoded so far are returned
+// along with the error.
+func decodeEntries(body []byte) ([]CRTEntry, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	if tok == nil {
+		return nil, nil // "null", same as no results
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return nil, fmt.Errorf("expected a JSON array, got %v", tok)
+	}
+
+	var entries []CRTEntry
+	for dec.More() {
+		var e CRTEntry
+		if err := dec.Decode(&e); err != nil {
+			return entries, err
+		}
+		entries = append(entries, e)
+	}
+	if _, err := dec.Token(); err != nil {
+		return entries, err
+	}
+	return entries, nil
+}
+
+// fetchCrtForDomain queries crt.sh for a given domain, extracts subdomains and wildcard roots,
+// and enqueues new wildcard roots for further processing. It returns an error if the query failed.
+func fetchCrtForDomain(
+	ctx context.Context,
+	current string,
+	scan *domainScan,
+	opts *Options,
+) error {
+	lf := logFields{Domain: scan.domain, Query: current}
+	// Merge the results of every query for the mode; partial results are
+	// kept as long as at least one query succeeded.
+	fetch := func() ([]CRTEntry, error) {
+		var all []CRTEntry
+		var lastErr error
+		anyOK := false
+		for _, q := range crtQueries(current, opts.queryMode) {
+			entries, err := fetchRetryEmpty(ctx, scan.domain, current, q, opts)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			anyOK = true
+			all = append(all, entries...)
+		}
+		if !anyOK {
+			return nil, lastErr
+		}
+		return all, nil
+	}
+
+	var entries []CRTEntry
+	var hit bool
+	var err error
+	if opts.cache != nil {
+		entries, hit, err = opts.cache.get(current, fetch)
+	} else {
+		entries, err = fetch()
+	}
+	if err != nil {
+		return err
+	}
+	if hit {
+		logInfo(lf, "Reusing cached crt.sh results for *.%s", current)
+	}
+
+	if len(entries) == 0 {
+		logInfo(lf, "No results for %s", current)
+		return nil
+	}
+	if opts.skipApexOnly && apexOnly(entries, current, !opts.noCommonName) {
+		logInfo(lf, "Only %s itself in the results; skipping (-skip-apex-only)", current)
+		return nil
+	}
+
+	scan.addEntries(current, entries, opts)
+	return nil
+}
+
+// emit prints a new subdomain with -stream. With -first-n, only the first n
+// are printed, and those are the ones written to subs.txt. Callers must hold
+// scan.mu or be the only goroutine using scan.
+func (scan *domainScan) emit(name string, opts *Options) {
+	if !opts.stream {
+		return
+	}
+	if opts.firstN > 0 && !opts.flatOnly {
+		if len(scan.streamed) >= opts.firstN {
+			return
+		}
+		scan.streamed = append(scan.streamed, name)
+	}
+	emitResult(name)
+}
+
+// keepSubdomain reports whether a plain subdomain passes -exclude, -include,
+// -scope-results and -sample-rate. -exclude wins over -include.
+func keepSubdomain(name string, opts *Options) bool {
+	if matchesAny(opts.exclude, name) || !included(opts.include, name) || (opts.scopeResults && !inScope(opts.scope, name)) {
+		return false
+	}
+	return sampled(opts.sampleRate, opts.sampleSeed, name)
+}
+
+// cleanName normalizes a name from a certificate, so that Unicode and
+// punycode spellings, and "name." and "name", collapse to one entry.
+func cleanName(raw string) string {
+	return toASCII(trimTrailingDot(strings.TrimSpace(strings.Trim(raw, "\r"))))
+}
+
+// apexOnly reports whether the only name on any of entries is name itself,
+// so the query found no subdomains or wildcards below it.
+func apexOnly(entries []CRTEntry, name string, withCommonName bool) bool {
+	for _, e := range entries {
+		for _, raw := range e.names(withCommonName) {
+			if cleanName(raw) != name {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// emptyRetryDelay is the wait before the first -retry-on-empty query. It
+// doubles for each further one.
+const emptyRetryDelay = 5 * time.Second
+
+// retryFailedDelay is the pause before the first -retry-failed pass. It
+// doubles for each further pass.
+const retryFailedDelay = 30 * time.Second
+
+// fetchRetryEmpty queries opts.source and, with -retry-on-empty, asks again
+// while the answer is empty, since an overloaded crt.sh sometimes returns "[]"
+// for names that do have certificates. If a repeated query fails outright,
+// the empty answer stands.
+func fetchRetryEmpty(ctx context.Context, domain, current, q string, opts *Options) ([]CRTEntry, error) {
+	entries, err := opts.source.fetch(ctx, opts, domain, current, q)
+	if err != nil || len(entries) > 0 || opts.emptyRetries <= 0 {
+		return entries, err
+	}
+
+	lf := logFields{Domain: domain, Query: current}
+	delay := emptyRetryDelay
+	for attempt := 1; attempt <= opts.emptyRetries; attempt++ {
+		if !opts.retryBudget.take() {
+			logWarn(lf, "Retry budget exhausted; accepting empty result for %s", current)
+			return nil, nil
+		}
+		logInfo(lf, "Empty result for %s; asking again in %s (%d/%d)", current, delay, attempt, opts.emptyRetries)
+		sleepCtx(ctx, delay)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		metrics.retries.Add(1)
+		entries, err = opts.source.fetch(ctx, opts, domain, current, q)
+		if err != nil {
+			return nil, nil
+		}
+		if len(entries) > 0 {
+			return entries, nil
+		}
+		delay *= 2
+	}
+	logInfo(lf, "Still no results for %s after %d more query(s); accepting it as empty", current, opts.emptyRetries)
+	return nil, nil
+}
+
+// addEntries records the names on the crt.sh entries: subdomains go to subs,
+// wildcard roots to wildcards and, unless -no-recurse is set, the queue.
+func (scan *domainScan) addEntries(from string, entries []CRTEntry, opts *Options) {
+	scan.mu.Lock()
+	defer scan.mu.Unlock()
+
+	// Roots found here are one level deeper than the query that found them
+	depth := scan.depth[from] + 1
+	recurse := !opts.noRecurse && (opts.maxDepth < 0 || depth <= opts.maxDepth)
+
+	// A name can be reported by several sources; remember all of them
+	var source sourceMask
+	if scan.sources != nil {
+		source = opts.source.id()
+	}
+
+	// Deduplicate name values
+	namesSeen := make(map[string]struct{})
+
+	for _, e := range entries {
+		if e.ID > scan.maxID {
+			scan.maxID = e.ID
+		}
+		if e.ID <= scan.sinceID {
+			continue
+		}
+		for _, raw := range e.names(!opts.noCommonName) {
+			name := cleanName(raw)
+			if name == "" {
+				continue
+			}
+			// Keep the most recent certificate for each subdomain that is kept
+			if scan.certs != nil && !strings.HasPrefix(name, "*.") && keepSubdomain(name, opts) {
+				if d, ok := scan.certs[name]; !ok || e.newerThan(d) {
+					scan.certs[name] = CertDetails{
+						Name:       name,
+						ID:         e.ID,
+						IssuerName: e.IssuerName,
+						NotBefore:  e.NotBefore,
+						NotAfter:   e.NotAfter,
+					}
+				}
+			}
+
+			if _, ok := namesSeen[name]; ok {
+				continue
+			}
+			namesSeen[name] = struct{}{}
+
+			if strings.HasPrefix(name, "*.") {
+				// Clean wildcard: "*.ae.aliexpress.com" -> "ae.aliexpress.com"
+				clean := strings.TrimPrefix(name, "*.")
+				if clean == "" {
+					continue
+				}
+				if matchesAny(opts.exclude, clean) || (opts.scopeResults && !inScope(opts.scope, clean)) {
+					continue
+				}
+				// Store wildcard root
+				scan.wildcards.Add(clean)
+				// The root is a hostname in its own right
+				if opts.wildcardsAsSubs && included(opts.include, clean) && sampled(opts.sampleRate, opts.sampleSeed, clean) {
+					if scan.sources != nil {
+						scan.sources[clean] |= source
+					}
+					if scan.subs.Add(clean) {
+						metrics.subdomains.Add(1)
+						scan.emit(clean, opts)
+					}
+				}
+				// Enqueue for further processing if not already seen
+				if !scan.seen.Contains(clean) && recurse {
+					scan.queue = append(scan.queue, clean)
+					if _, ok := scan.depth[clean]; !ok {
+						scan.depth[clean] = depth
+					}
+				}
+			} else {
+				if !keepSubdomain(name, opts) {
+					continue
+				}
+				if scan.sources != nil {
+					scan.sources[name] |= source
+				}
+				if scan.subs.Add(name) {
+					metrics.subdomains.Add(1)
+					scan.emit(name, opts)
+				}
+			}
+		}
+	}
+}
+
+func processDomain(
+	ctx context.Context,
+	domain string,
+	opts *Options,
+) error {
+	lf := logFields{Domain: domain}
+	if err := validatePathElement(domain); err != nil {
+		return fmt.Errorf("refusing to use %q as output directory: %w", domain, err)
+	}
+	if opts.probe {
+		return probeDomain(ctx, domain, opts)
+	}
+	logSuccess(lf, "Processing %s", domain)
+
+	subsPath := opts.outputName(domain, opts.subsFilename)
+	wildcardsPath := opts.outputName(domain, opts.wildcardsFilename)
+	flatPath := opts.outputName(domain, "all.txt")
+	donePath := opts.outputName(domain, doneMarker)
+	dir := domain
+	if opts.flattenOutput {
+		dir = "."
+	}
+
+	// If skipDone is enabled and an earlier run finished this domain, skip.
+	// A non-empty subs.txt alone could also be left over from a crash.
+	if opts.skipDone && !opts.countOnly {
+		if _, err := opts.output.Size(donePath); err == nil {
+			logInfo(lf, "Skipping %s (already completed)", domain)
+			logBreak()
+			return nil
+		}
+	}
+
+	var seeds []string
+	for _, s := range opts.seeds {
+		if isSubdomainOf(s, domain) {
+			seeds = append(seeds, s)
+		}
+	}
+	if len(seeds) > 0 {
+		logInfo(lf, "Starting from %d name(s) in the seed file instead of %s", len(seeds), domain)
+	}
+	scan := newDomainScan(domain, seeds, opts.withCertDetails)
+	if opts.withSource {
+		scan.sources = make(map[string]sourceMask)
+	}
+	if id := opts.sinceIDs.get(domain); id > 0 {
+		scan.sinceID, scan.maxID = id, id
+		logInfo(lf, "Ignoring certificates up to crt.sh ID %d (seen by an earlier run)", id)
+	}
+
+	drain := func() {
+		for {
+			current, ok := scan.next()
+			if !ok {
+				return
+			}
+			if ctx.Err() != nil {
+				// Out of time: drain the queue without querying
+				scan.done()
+				continue
+			}
+			if err := fetchCrtForDomain(ctx, current, scan, opts); err != nil && scan.seeds.Contains(current) {
+				scan.mu.Lock()
+				scan.seedErr = fmt.Errorf("crt.sh query for %s failed: %w", current, err)
+				scan.failed = append(scan.failed, current)
+				scan.mu.Unlock()
+			}
+			scan.done()
+		}
+	}
+
+	if opts.domainWorkers <= 1 {
+		drain()
+	} else {
+		var wg sync.WaitGroup
+		for i := 0; i < opts.domainWorkers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				drain()
+			}()
+		}
+		wg.Wait()
+	}
+
+	// The domain only fails if no seed could be queried; otherwise the other
+	// seeds' results are worth keeping
+	if len(scan.failed) == scan.seeds.Len() {
+		return scan.seedErr
+	}
+	if len(scan.failed) > 0 {
+		sortNames(scan.failed, opts.sortMode)
+		logWarn(lf, "%d of %d seed queries failed for %s, writing partial results without them: %s", len(scan.failed), scan.seeds.Len(), domain, strings.Join(scan.failed, ", "))
+	}
+
+	// Results are still written when the run is cut short, but the domain is
+	// reported as interrupted so it isn't recorded as completed.
+	var interrupted error
+	if err := ctx.Err(); err != nil {
+		interrupted = fmt.Errorf("interrupted (%w), partial results written", err)
+		logWarn(lf, "Run stopped early; writing partial results for %s", domain)
+	} else if scan.subs.Len() < opts.minResults {
+		// Suspiciously few results usually mean crt.sh throttled or timed out
+		logWarn(logFields{Domain: domain, Event: eventLowResults}, "LOW RESULTS: %s has %d subdomain(s), below -min-results %d; consider re-scanning", domain, scan.subs.Len(), opts.minResults)
+	}
+
+	if opts.collapseWildcards {
+		scan.wildcards = collapseWildcards(scan.wildcards)
+	}
+
+	// The apex is an input, not a discovered wildcard root, so it only goes to subs
+	if opts.includeApex && scan.subs.Add(domain) {
+		scan.emit(domain, opts)
+	}
+
+	if opts.trimWWW {
+		scan.subs = trimWWW(scan.subs)
+	}
+
+	if opts.roots != nil {
+		addRoots(opts.roots, scan.subs)
+		addRoots(opts.roots, scan.wildcards)
+	}
+
+	if opts.countOnly {
+		if interrupted != nil {
+			return interrupted
+		}
+		opts.counts.add(scan.subs.Len(), scan.wildcards.Len())
+		emitResult(fmt.Sprintf("%s: %d subdomains, %d wildcards", domain, scan.subs.Len(), scan.wildcards.Len()))
+		return nil
+	}
+
+	if err := writeDomainFiles(lf, domain, scan, opts, true); err != nil {
+		return err
+	}
+
+	if interrupted != nil {
+		return interrupted
+	}
+
+	// Write resolved.txt with the subdomains that resolve
+	if opts.resolver != nil {
+		resolved := opts.resolver.resolveAll(ctx, scan.subs.Sorted())
+		if err := writeResolved(opts.output, opts.outputName(domain, "resolved.txt"), resolved, opts.sortMode); err != nil {
+			return fmt.Errorf("failed to write resolved.txt for %s: %w", domain, err)
+		}
+		logInfo(lf, "%d of %d subdomain(s) resolved", len(resolved), scan.subs.Len())
+	}
+
+	// Only advance the mark once the results for it are written
+	if opts.sinceIDs != nil {
+		if err := opts.sinceIDs.update(domain, scan.maxID); err != nil {
+			return fmt.Errorf("failed to update since-id file: %w", err)
+		}
+	}
+
+	// Written last, so it only exists if every file above was written
+	if err := opts.output.WriteFile(donePath, []byte(time.Now().UTC().Format(time.RFC3339)+"\n")); err != nil {
+		return fmt.Errorf("failed to write %s for %s: %w", doneMarker, domain, err)
+	}
+
+	if opts.flatOnly {
+		subsPath, wildcardsPath = flatPath, flatPath
+	} else if !hasFormat(opts.formats, formatTxt) {
+		// No subs.txt; hand the hook the first file that was written
+		subsPath = opts.outputName(domain, resultsFile(opts.formats[0]))
+		wildcardsPath = subsPath
+	}
+	opts.onComplete.run(domain, dirLocation(opts.output, dir), opts.output.Location(subsPath), opts.output.Location(wildcardsPath))
+
+	logSuccess(lf, "Done: %d subdomains, %d wildcard roots → %s/", scan.subs.Len(), scan.wildcards.Len(), dirLocation(opts.output, dir))
+	logBreak()
+	return nil
+}
+
+// writeDomainFiles writes what scan collected to the output files of domain
+// (an input domain, or the directory of an -org run) in every -format. It
+// merges in earlier results with -append and applies -first-n, so all files
+// agree. wildcards_external.txt is only written if external is set.
+func writeDomainFiles(lf logFields, domain string, scan *domainScan, opts *Options, external bool) error {
+	subsPath := opts.outputName(domain, opts.subsFilename)
+	wildcardsPath := opts.outputName(domain, opts.wildcardsFilename)
+	externalPath := opts.outputName(domain, "wildcards_external.txt")
+	certsPath := opts.outputName(domain, "subs.json")
+	flatPath := opts.outputName(domain, "all.txt")
+
+	// Merge in what earlier runs found, from the txt files if they are
+	// written and from the results files otherwise (all.txt is merged below)
+	if opts.appendMode {
+		if hasFormat(opts.formats, formatTxt) && !opts.flatOnly {
+			if err := mergeExisting(opts.output, subsPath, scan.subs); err != nil {
+				return fmt.Errorf("failed to merge existing %s for %s: %w", opts.subsFilename, domain, err)
+			}
+			if err := mergeExisting(opts.output, wildcardsPath, scan.wildcards); err != nil {
+				return fmt.Errorf("failed to merge existing %s for %s: %w", opts.wildcardsFilename, domain, err)
+			}
+		} else {
+			for _, format := range opts.formats {
+				if format == formatTxt {
+					continue
+				}
+				name := resultsFile(format)
+				if err := mergeResults(opts.output, opts.outputName(domain, name), format, scan.subs, scan.wildcards); err != nil {
+					return fmt.Errorf("failed to merge existing %s for %s: %w", name, domain, err)
+				}
+			}
+		}
+		if opts.collapseWildcards {
+			scan.wildcards = collapseWildcards(scan.wildcards)
+		}
+		if opts.trimWWW {
+			scan.subs = trimWWW(scan.subs)
+		}
+	}
+
+	// Cap the subdomains once, so every format gets the same list. With
+	// -stream, the cap keeps the names already printed.
+	if !opts.flatOnly {
+		n := firstN(scan.subs, opts.firstN, opts.sortMode)
+		if opts.stream && opts.firstN > 0 {
+			n = NewStringSet()
+			for _, name := range scan.streamed {
+				if scan.subs.Contains(name) {
+					n.Add(name)
+				}
+			}
+		}
+		if n.Len() < scan.subs.Len() {
+			logInfo(lf, "Writing the first %d of %d subdomains (-first-n)", n.Len(), scan.subs.Len())
+			scan.subs = n
+		}
+	}
+
+	// Only the serialization differs between formats
+	for _, format := range opts.formats {
+		if format != formatTxt {
+			name := resultsFile(format)
+			if err := writeResults(opts.output, opts.outputName(domain, name), format, domain, scan.subs, scan.wildcards, scan.sources, opts.sortMode); err != nil {
+				return fmt.Errorf("failed to write %s for %s: %w", name, domain, err)
+			}
+			continue
+		}
+		if opts.flatOnly {
+			continue
+		}
+
+		// Write subs.txt (sorted, unique)
+		if err := writeSetSorted(opts.output, subsPath, scan.subs, opts.sortMode); err != nil {
+			return fmt.Errorf("failed to write %s for %s: %w", opts.subsFilename, domain, err)
+		}
+
+		// Write wildcards_clean.txt (sorted, unique)
+		if err := writeSetSorted(opts.output, wildcardsPath, scan.wildcards, opts.sortMode); err != nil {
+			return fmt.Errorf("failed to write %s for %s: %w", opts.wildcardsFilename, domain, err)
+		}
+
+		// Write wildcards_external.txt (roots outside the input domain)
+		if external {
+			if err := writeSetSorted(opts.output, externalPath, externalWildcards(domain, scan.wildcards), opts.sortMode); err != nil {
+				return fmt.Errorf("failed to write wildcards_external.txt for %s: %w", domain, err)
+			}
+		}
+	}
+
+	// Write all.txt (every hostname, subdomains and wildcard roots alike)
+	if opts.flat {
+		all := union(scan.subs, scan.wildcards)
+		if opts.appendMode {
+			if err := mergeExisting(opts.output, flatPath, all); err != nil {
+				return fmt.Errorf("failed to merge existing all.txt for %s: %w", domain, err)
+			}
+		}
+		if err := writeSetSorted(opts.output, flatPath, all, opts.sortMode); err != nil {
+			return fmt.Errorf("failed to write all.txt for %s: %w", domain, err)
+		}
+	}
+
+	// Write subs_sources.json with the sources of each subdomain, unless
+	// results.json or results.csv already carry them
+	if opts.withSource && !hasFormat(opts.formats, formatJSON) && !hasFormat(opts.formats, formatCSV) {
+		if err := writeSources(opts.output, opts.outputName(domain, "subs_sources.json"), scan.subs, scan.sources, opts.sortMode); err != nil {
+			return fmt.Errorf("failed to write subs_sources.json for %s: %w", domain, err)
+		}
+	}
+
+	// Write subs.json with per-subdomain certificate details
+	if opts.withCertDetails {
+		if err := writeCertDetails(opts.output, certsPath, scan.subs, scan.certs, opts.sortMode); err != nil {
+			return fmt.Errorf("failed to write subs.json for %s: %w", domain, err)
+		}
+	}
+	return nil
+}
+
+// doneMarker is written into a domain's directory once all of its output
+// files are complete; -skip-done looks for it.
+const doneMarker = ".done"
+
+// defaultCrtshURL is queried unless -crtsh-url points at a mirror.
+const defaultCrtshURL = "https://crt.sh/"
+
+// maxAutoWorkers is the number of workers started by -workers auto.
+const maxAutoWorkers = 8
+
+// preflightName is queried (exact match) before a run to check that crt.sh is
+// up. It only has a handful of certificates, so the response is small.
+const preflightName = "crt.sh"
+
+// Process exit codes.
+const (
+	exitOK         = 0 // every domain succeeded
+	exitSomeFailed = 1 // at least one domain failed (also used for usage errors)
+	exitAllFailed  = 2 // every attempted domain failed
+	exitDeadline   = 3 // -max-runtime cut the run short
+)
+
+func main() {
+	// Flags default to the values of DefaultOptions; NewOptions below builds
+	// the Options of the run from the parsed flags
+	defaults := DefaultOptions()
+	rateLimitSec := flag.Int("rate", int(defaults.rateLimit/time.Second), "delay in seconds between crt.sh requests")
+	maxRetries := flag.Int("retries", defaults.maxRetries, "maximum retry attempts for each request")
+	skipDone := flag.Bool("skip-done", defaults.skipDone, "skip domains that an earlier run completed (their directory has a .done marker)")
+	workersFlag := flag.String("workers", strconv.Itoa(defaults.workers), "number of concurrent workers (1 = no concurrency), or \"auto\" to adapt to crt.sh throttling")
+	domainWorkers := flag.Int("domain-workers", defaults.domainWorkers, "number of concurrent queries within a single domain (1 = sequential)")
+	timeoutSec := flag.Int("timeout", int(defaults.client.Timeout/time.Second), "HTTP client timeout in seconds")
+	requestTimeout := flag.Duration("request-timeout", 0, "per-attempt limit on waiting for crt.sh to start responding, e.g. 10s (0 = only -timeout applies)")
+	stream := flag.Bool("stream", false, "print each new subdomain to stdout as it is found (logs go to stderr)")
+	formatList := flag.String("format", strings.Join(defaults.formats, ","), "comma-separated output formats: txt (subs.txt and wildcard lists), json (results.json), csv (results.csv)")
+	withSource := flag.Bool("with-source", false, "record which sources reported each subdomain, in results.json/results.csv or, with -format txt only, in subs_sources.json")
+	withCertDetails := flag.Bool("with-cert-details", false, "also write subs.json with issuer, validity dates and crt.sh ID per subdomain")
+	dedupQueries := flag.Bool("dedup-queries", false, "share crt.sh results across input domains so no query is issued twice per run")
+	noRecurse := flag.Bool("no-recurse", false, "only query the input domain itself; record wildcard roots but do not follow them")
+	flattenOutput := flag.Bool("flatten-output", false, "when scanning a single domain, write example.com-subs.txt etc. to the current directory instead of example.com/")
+	noCommonName := flag.Bool("no-common-name", false, "only use the names in name_value and ignore the certificate's common_name")
+	maxDepth := flag.Int("max-depth", defaults.maxDepth, "follow wildcard roots at most this many levels deep (0 = same as -no-recurse, -1 = unlimited)")
+	resume := flag.Bool("resume", false, "skip domains recorded as completed in the state file by a previous run")
+	stateFile := flag.String("state-file", ".crt-subfinder-state.json", "path of the run manifest used by -resume")
+	jsonLogsFlag := flag.Bool("json-logs", false, "write diagnostic output as one JSON object per line")
+	excludeList := flag.String("exclude", "", "comma-separated patterns of names to drop (globs, or regexes prefixed with \"re:\")")
+	includeList := flag.String("include", "", "comma-separated patterns; if set, only subdomains matching one of them are kept (same syntax as -exclude)")
+	countOnly := flag.Bool("count-only", false, "run the full enumeration but only print per-domain counts, writing no files")
+	probe := flag.Bool("probe", false, "issue one query per domain and only report has-data, no-data or error, writing no files")
+	failuresFile := flag.String("failures", "", "write each domain that failed, with the reason, to this file (one \"domain<TAB>reason\" line each)")
+	retryFailed := flag.Int("retry-failed", 0, "after the run, process the domains that failed again, up to this many extra passes with growing pauses in between")
+	retryOnEmpty := flag.Bool("retry-on-empty", false, "treat an empty crt.sh answer as possibly transient and ask again (up to -retries more times, with growing delays)")
+	firstNFlag := flag.Int("first-n", 0, "write at most this many subdomains to subs.txt per domain, taken after sorting, or the first ones printed with -stream (0 = all)")
+	crtshURL := flag.String("crtsh-url", defaults.baseURL, "base URL of crt.sh or a compatible mirror")
+	insecure := flag.Bool("insecure", false, "skip TLS certificate verification (unsafe; only for trusted internal mirrors with self-signed certificates)")
+	var headers headerFlag
+	flag.Var(&headers, "header", "extra HTTP header \"Name: Value\" sent with every crt.sh request (repeatable)")
+	gzipOut := flag.Bool("gzip", false, "write every output file gzip-compressed, with a .gz extension")
+	resolve := flag.Bool("resolve", false, "resolve every subdomain found and write those that resolve to resolved.txt")
+	resolveWorkers := flag.Int("resolve-workers", 20, "number of concurrent DNS lookups for -resolve, shared by all domains")
+	resolveTimeout := flag.Duration("resolve-timeout", 5*time.Second, "timeout for each DNS lookup with -resolve")
+	resolvers := flag.String("resolvers", "", "comma-separated DNS servers for -resolve, e.g. 8.8.8.8,1.1.1.1 (default: system resolver)")
+	queryMode := flag.String("query-mode", defaults.queryMode, "crt.sh query type: wildcard (%.domain), exact (domain) or both")
+	maxRuntime := flag.Duration("max-runtime", 0, "stop the whole run after this long, e.g. 30m (0 = no limit)")
+	strict := flag.Bool("strict", false, "abort the run as soon as any domain fails")
+	sortMode := flag.String("sort", defaults.sortMode, "output order: lex (alphabetical) or reverse (grouped by parent domain)")
+	appendMode := flag.Bool("append", false, "merge new results into existing output files (subs.txt/wildcards_clean.txt, or the -format results files without txt) instead of replacing them (implies -skip-done=false)")
+	excludeExpired := flag.Bool("exclude-expired", false, "only consider certificates that have not expired yet")
+	maxIdlePerHost := flag.Int("max-idle-per-host", 0, "idle HTTP connections kept per host (0 = workers × domain-workers)")
+	showVersion := flag.Bool("version", false, "print version information and exit")
+	scopeList := flag.String("scope", "", "comma-separated domain suffixes (or regexes prefixed with \"re:\"); input domains outside them are skipped")
+	scopeResults := flag.Bool("scope-results", false, "also drop discovered names and wildcard roots outside -scope")
+	retryBudgetN := flag.Int("retry-budget", 0, "maximum number of retries across the whole run (0 = unlimited)")
+	logFilePath := flag.String("log-file", "", "also append all diagnostic output, with timestamps, to this file")
+	print0Flag := flag.Bool("print0", false, "end each result printed to stdout (-stream, -count-only, -probe, -diff) with a NUL byte instead of a newline, for xargs -0")
+	silentFlag := flag.Bool("silent", false, "only log warnings and errors, and never show the progress line")
+	quietErrors := flag.Bool("quiet-errors", false, "don't log individual failed attempts; only report requests that give up after all retries")
+	skipPreflight := flag.Bool("skip-preflight", false, "don't check that crt.sh is reachable before starting")
+	s3Bucket := flag.String("s3-bucket", "", "upload results to this S3 bucket instead of the local filesystem")
+	s3Prefix := flag.String("s3-prefix", "", "key prefix for results in -s3-bucket")
+	s3Endpoint := flag.String("s3-endpoint", "", "endpoint URL for S3-compatible storage (default: AWS S3 for $AWS_REGION)")
+	subsFilename := flag.String("subs-filename", defaults.subsFilename, "name of the subdomain list written in each domain directory")
+	wildcardsFilename := flag.String("wildcards-filename", defaults.wildcardsFilename, "name of the wildcard root list written in each domain directory")
+	collapse := flag.Bool("collapse-wildcards", false, "drop wildcard roots that are subdomains of another wildcard root in the same list")
+	skipApexOnly := flag.Bool("skip-apex-only", false, "ignore a query's results when the queried name itself is the only name on them")
+	trimWWWFlag := flag.Bool("trim-www", false, "drop www.X from the subdomains when X was found as well")
+	backend := flag.String("backend", backendHTTP, "how to query crt.sh: http (JSON API) or postgres (its public database)")
+	pgAddr := flag.String("pg-addr", defaultPostgresAddr, "host:port of the crt.sh database for -backend postgres")
+	onComplete := flag.String("on-complete", "", "shell command to run after each finished domain; {domain}, {dir}, {subs_file} and {wildcards_file} are substituted")
+	onCompleteTimeout := flag.Duration("on-complete-timeout", 5*time.Minute, "time limit for each -on-complete command")
+	sinceIDFile := flag.String("since-id-file", "", "JSON file of the highest crt.sh certificate ID seen per domain; only newer certificates are reported, and the file is updated")
+	flat := flag.Bool("flat", false, "also write all.txt with every hostname (subdomains and wildcard roots) in one list")
+	flatOnly := flag.Bool("flat-only", false, "write only all.txt, not subs.txt and the wildcard files (implies -flat)")
+	wildcardsAsSubs := flag.Bool("wildcards-as-subs", false, "also list each wildcard root (e.g. api.example.com from *.api.example.com) in subs.txt")
+	includeApex := flag.Bool("include-apex", false, "always list the input domain itself in subs.txt")
+	parseURLs := flag.Bool("parse-urls", false, "accept URLs in the input (e.g. https://app.example.com/path) and scan their host")
+	streamInput := flag.Bool("stream-input", false, "read input files while scanning instead of up front, keeping memory flat for huge lists (no deduplication)")
+	shuffle := flag.Bool("shuffle", false, "process input domains in random order")
+	seed := flag.Int64("seed", 0, "random seed for -shuffle and -sample-rate, for reproducible runs (0 = based on the current time for -shuffle)")
+	sampleRate := flag.Float64("sample-rate", defaults.sampleRate, "keep each discovered subdomain with this probability, e.g. 0.1 for roughly a tenth (1 = keep all)")
+	emitRoots := flag.String("emit-roots", "", "write the apex domains of all discovered names to this file")
+	maxRPS := flag.Float64("max-rps", 0, "hard ceiling on crt.sh requests per second across all workers, retries and the preflight check included (0 = none)")
+	hostRates := flag.String("host-rate", "", "comma-separated host=interval pairs (e.g. crt.sh=2s) spacing requests to each host across all workers")
+	seedFile := flag.String("seed-file", "", "file of names (e.g. a previous wildcards_clean.txt) to start each domain's queue from instead of the bare domain")
+	org := flag.String("org", "", "query crt.sh for certificates issued to this organization instead of reading an input file")
+	expand := flag.String("expand", "", "combine the wildcard roots in this file with -wordlist into word.root candidates for bruteforcing; crt.sh is not queried")
+	wordlist := flag.String("wordlist", "", "file of words for -expand, one per line")
+	expandOutput := flag.String("expand-output", "", "write the -expand candidates to this file instead of stdout")
+	diffMode := flag.Bool("diff", false, "compare two result files given as arguments (old new) and print added (+) and removed (-) names; crt.sh is not queried")
+	minResults := flag.Int("min-results", 0, "warn when a domain yields fewer than this many subdomains (0 = never)")
+	metricsAddr := flag.String("metrics-addr", "", "serve Prometheus metrics on this address, e.g. :9090 (empty = disabled)")
+	configPath := flag.String("config", "", "JSON config file with flag defaults (command-line flags take precedence)")
+
+	flag.Parse()
+	started := time.Now()
+
+	if *showVersion {
+		fmt.Printf("crt-subfinder %s (commit %s, built %s)\n", version, commit, date)
+		return
+	}
+
+	if *configPath != "" {
+		values, err := loadConfig(*configPath)
+		if err == nil {
+			err = applyConfig(flag.CommandLine, *configPath, values)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *stream || *countOnly || *probe || *diffMode || (*expand != "" && *expandOutput == "") {
+		logOut = os.Stderr
+	}
+	jsonLogs = *jsonLogsFlag
+	quietAttempts = *quietErrors
+	silent = *silentFlag
+	print0 = *print0Flag
+
+	if *logFilePath != "" {
+		f, err := os.OpenFile(*logFilePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			logError(logFields{}, "Error: -log-file: %v", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		logFile = f
+		// Record what was run, for reconstructing scheduled scans later.
+		// -header values are left out, as they often hold credentials.
+		logInfo(logFields{}, "crt-subfinder %s (commit %s) started: %s", version, commit, strings.Join(redactHeaderArgs(os.Args), " "))
+		if *configPath != "" {
+			logInfo(logFields{}, "Flag defaults loaded from %s", *configPath)
+		}
+	}
+
+	// -workers auto starts maxAutoWorkers workers and lets the shared limiter
+	// decide how many of them may query crt.sh at once
+	autoWorkers := *workersFlag == "auto"
+	var workers int
+	if autoWorkers {
+		workers = maxAutoWorkers
+	} else if n, err := strconv.Atoi(*workersFlag); err == nil {
+		workers = n
+	} else {
+		logError(logFields{}, "Error: -workers must be a number or \"auto\"")
+		os.Exit(1)
+	}
+
+	if *retryFailed < 0 {
+		logError(logFields{}, "Error: -retry-failed must not be negative")
+		os.Exit(1)
+	}
+
+	exclude, err := parsePatterns(*excludeList)
+	if err != nil {
+		logError(logFields{}, "Error: -exclude: %v", err)
+		os.Exit(1)
+	}
+	include, err := parsePatterns(*includeList)
+	if err != nil {
+		logError(logFields{}, "Error: -include: %v", err)
+		os.Exit(1)
+	}
+
+	scope, err := parseScope(*scopeList)
+	if err != nil {
+		logError(logFields{}, "Error: -scope: %v", err)
+		os.Exit(1)
+	}
+
+	// NewOptions reports flags that are out of range or inconsistent
+	opts, err := NewOptions(func(opts *Options) {
+		opts.rateLimit = time.Duration(*rateLimitSec) * time.Second
+		opts.maxRetries = *maxRetries
+		opts.skipDone = *skipDone
+		opts.withCertDetails = *withCertDetails
+		opts.withSource = *withSource
+		opts.stream = *stream
+		opts.noRecurse = *noRecurse
+		opts.noCommonName = *noCommonName
+		opts.maxDepth = *maxDepth
+		opts.domainWorkers = *domainWorkers
+		opts.exclude = exclude
+		opts.include = include
+		opts.countOnly = *countOnly
+		opts.probe = *probe
+		opts.firstN = *firstNFlag
+		opts.sampleRate = *sampleRate
+		opts.sampleSeed = *seed
+		opts.queryMode = *queryMode
+		opts.sortMode = *sortMode
+		opts.appendMode = *appendMode
+		opts.excludeExpired = *excludeExpired
+		opts.scope = scope
+		opts.scopeResults = *scopeResults
+		opts.retryBudget = newRetryBudget(*retryBudgetN)
+		opts.minResults = *minResults
+		opts.includeApex = *includeApex
+		opts.wildcardsAsSubs = *wildcardsAsSubs
+		opts.flat = *flat || *flatOnly
+		opts.flatOnly = *flatOnly
+		opts.collapseWildcards = *collapse
+		opts.trimWWW = *trimWWWFlag
+		opts.skipApexOnly = *skipApexOnly
+		opts.formats = splitFormats(*formatList)
+		opts.workers = workers
+		opts.subsFilename = *subsFilename
+		opts.wildcardsFilename = *wildcardsFilename
+		if *emitRoots != "" {
+			opts.roots = NewStringSet()
+		}
+		if *retryOnEmpty {
+			opts.emptyRetries = *maxRetries
+		}
+		if *onComplete != "" {
+			opts.onComplete = newCompletionHook(*onComplete, *onCompleteTimeout, workers)
+		}
+		if *sinceIDFile != "" {
+			opts.sinceIDs, err = loadSinceIDs(*sinceIDFile)
+			if err != nil {
+				logError(logFields{}, "Error: %v", err)
+				os.Exit(1)
+			}
+		}
+		opts.limiter, err = parseHostRates(*hostRates)
+		if err != nil {
+			logError(logFields{}, "Error: -host-rate: %v", err)
+			os.Exit(1)
+		}
+		if *maxRPS < 0 {
+			logError(logFields{}, "Error: -max-rps must not be negative")
+			os.Exit(1)
+		}
+		if *maxRPS > 0 {
+			if opts.limiter == nil {
+				opts.limiter = newHostLimiter()
+			}
+			opts.limiter.gap = rpsGap(*maxRPS)
+		}
+		if autoWorkers {
+			if opts.limiter == nil {
+				opts.limiter = newHostLimiter()
+			}
+			opts.limiter.adaptive = newAIMDLimiter(workers * max(*domainWorkers, 1))
+		}
+		if *resolve {
+			servers, err := parseResolvers(*resolvers)
+			if err != nil {
+				logError(logFields{}, "Error: -resolvers: %v", err)
+				os.Exit(1)
+			}
+			opts.resolver = newNameResolver(servers, *resolveWorkers, *resolveTimeout)
+		} else if *resolvers != "" {
+			logWarn(logFields{}, "-resolvers has no effect without -resolve")
+		}
+		if *seedFile != "" {
+			names, err := readNameFile(*seedFile)
+			if err != nil {
+				logError(logFields{}, "Error: -seed-file: %v", err)
+				os.Exit(1)
+			}
+			opts.seeds, _, _ = prepareDomains(names)
+		}
+		if *s3Bucket != "" {
+			backend, err := newS3Backend(*s3Bucket, *s3Prefix, *s3Endpoint)
+			if err != nil {
+				logError(logFields{}, "Error: %v", err)
+				os.Exit(1)
+			}
+			opts.output = backend
+		}
+		if *gzipOut {
+			opts.output = gzipBackend{inner: opts.output}
+		}
+		// Appending only makes sense if finished domains are scanned again
+		if *appendMode {
+			opts.skipDone = false
+		}
+
+		opts.baseURL = *crtshURL
+		if u, err := url.Parse(opts.baseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" {
+			logError(logFields{}, "Error: -crtsh-url must be an http(s) URL without a query string, e.g. %s", defaultCrtshURL)
+			os.Exit(1)
+		}
+		if *backend == backendPostgres && opts.baseURL != defaultCrtshURL {
+			logWarn(logFields{}, "-crtsh-url has no effect with -backend %s; use -pg-addr", backendPostgres)
+		}
+
+		if *dedupQueries {
+			opts.cache = newQueryCache()
+		}
+
+		// One shared transport so connections to crt.sh are reused across
+		// requests and workers instead of being churned.
+		idlePerHost := *maxIdlePerHost
+		if idlePerHost <= 0 {
+			idlePerHost = max(workers, 1) * max(*domainWorkers, 1)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.MaxIdleConns = max(100, idlePerHost)
+		transport.MaxIdleConnsPerHost = idlePerHost
+		transport.IdleConnTimeout = 90 * time.Second
+		// -timeout also covers downloading large bodies, so it has to be generous;
+		// -request-timeout fails stuck attempts early without cutting off slow downloads.
+		if *requestTimeout > 0 {
+			transport.ResponseHeaderTimeout = *requestTimeout
+			if *timeoutSec > 0 && *requestTimeout >= time.Duration(*timeoutSec)*time.Second {
+				logWarn(logFields{}, "-request-timeout %s is not shorter than -timeout %ds and has no effect", *requestTimeout, *timeoutSec)
+			}
+		}
+
+		if *insecure {
+			logWarn(logFields{}, "-insecure: TLS certificates are NOT verified; only use this with a trusted internal mirror")
+			transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		}
+
+		opts.client = &http.Client{
+			Timeout:   time.Duration(*timeoutSec) * time.Second,
+			Transport: transport,
+		}
+		if len(headers.header) > 0 {
+			opts.client.Transport = &headerTransport{base: transport, header: headers.header}
+		}
+
+		switch *backend {
+		case backendHTTP:
+			opts.source = &httpSource{}
+		case backendPostgres:
+			if *org != "" {
+				logError(logFields{}, "Error: -org is only supported with -backend %s", backendHTTP)
+				os.Exit(1)
+			}
+			opts.source = &postgresSource{
+				addr:     *pgAddr,
+				user:     "guest",
+				database: "certwatch",
+				password: os.Getenv("PGPASSWORD"),
+				timeout:  time.Duration(*timeoutSec) * time.Second,
+			}
+		default:
+			logError(logFields{}, "Error: -backend must be %q or %q", backendHTTP, backendPostgres)
+			os.Exit(1)
+		}
+
+		// -rate is a delay within each goroutine, so -domain-workers N would send
+		// one domain's queries N times as fast. The crt.sh host is then spaced
+		// out by -rate in the shared limiter too, which keeps the aggregate rate
+		// at one request per -rate across all workers.
+		if *domainWorkers > 1 && opts.rateLimit > 0 {
+			host := ""
+			if *backend == backendPostgres {
+				host, _, _ = net.SplitHostPort(*pgAddr)
+			} else if u, err := url.Parse(opts.baseURL); err == nil {
+				host = u.Hostname()
+			}
+			if opts.limiter == nil {
+				opts.limiter = newHostLimiter()
+			}
+			opts.limiter.spaceHost(host, opts.rateLimit)
+		}
+	})
+	if err != nil {
+		logError(logFields{}, "Error: %v", err)
+		os.Exit(1)
+	}
+
+	// Offline comparison of two earlier results; nothing else to do
+	if *diffMode {
+		if flag.NArg() != 2 {
+			logError(logFields{}, "Error: -diff needs exactly two files: old new")
+			os.Exit(1)
+		}
+		if err := runDiff(flag.Arg(0), flag.Arg(1), opts.sortMode); err != nil {
+			logError(logFields{}, "Error: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Offline expansion of wildcard roots into bruteforce candidates
+	if *expand != "" || *wordlist != "" {
+		if *expand == "" || *wordlist == "" {
+			logError(logFields{}, "Error: -expand and -wordlist must be used together")
+			os.Exit(1)
+		}
+		if err := runExpand(*expand, *wordlist, *expandOutput, opts.sortMode); err != nil {
+			logError(logFields{}, "Error: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// startRun sets up what every run needs right before crt.sh is queried
+	startRun := func() (context.Context, context.CancelFunc) {
+		// Bound the whole run when -max-runtime is set
+		ctx, cancel := context.WithCancel(context.Background())
+		if *maxRuntime > 0 {
+			ctx, cancel = context.WithTimeout(context.Background(), *maxRuntime)
+		}
+
+		if *metricsAddr != "" {
+			if err := serveMetrics(*metricsAddr); err != nil {
+				logError(logFields{}, "Error: -metrics-addr: %v", err)
+				os.Exit(1)
+			}
+		}
+
+		// Make sure crt.sh is up before grinding through the whole list
+		if !*skipPreflight {
+			logInfo(logFields{}, "Preflight: checking that crt.sh is reachable")
+			if _, err := opts.source.fetch(ctx, opts, "", preflightName, preflightName); err != nil {
+				logError(logFields{}, "Error: crt.sh is unreachable or not returning results; aborting (use -skip-preflight to try anyway)")
+				os.Exit(exitSomeFailed)
+			}
+		}
+		return ctx, cancel
+	}
+
+	// Organization mode replaces the input list with a single query
+	if *org != "" {
+		if *probe {
+			logError(logFields{}, "Error: -probe cannot be combined with -org")
+			os.Exit(1)
+		}
+		ctx, cancel := startRun()
+		err := runOrg(ctx, *org, opts)
+		cancel()
+		if err != nil {
+			logError(logFields{}, "Error: %v", err)
+			os.Exit(exitSomeFailed)
+		}
+		return
+	}
+
+	// Input files: all non-flag args or default "domains.txt"
+	inputFiles := flag.Args()
+	if len(inputFiles) == 0 {
+		inputFiles = []string{"domains.txt"}
+	}
+
+	// Check input files exist
+	for _, inputFile := range inputFiles {
+		if _, err := os.Stat(inputFile); err != nil {
+			logError(logFields{}, "Error: input file '%s' not found.", inputFile)
+			os.Exit(1)
+		}
+	}
+
+	// With -stream-input the files are read while the workers run instead
+	readFiles := inputFiles
+	if *streamInput {
+		if *shuffle {
+			logError(logFields{}, "Error: -shuffle needs the whole list and cannot be combined with -stream-input")
+			os.Exit(1)
+		}
+		for _, inputFile := range inputFiles {
+			if strings.EqualFold(filepath.Ext(inputFile), ".json") {
+				logError(logFields{}, "Error: -stream-input only supports plain name lists, not %s", inputFile)
+				os.Exit(1)
+			}
+			if *failuresFile != "" && filepath.Clean(inputFile) == filepath.Clean(*failuresFile) {
+				logError(logFields{}, "Error: with -stream-input, the -failures file cannot also be an input file")
+				os.Exit(1)
+			}
+		}
+		if *flattenOutput {
+			logWarn(logFields{}, "-flatten-output has no effect with -stream-input")
+		}
+		readFiles = nil
+	}
+
+	// Read domains first; duplicates across files are removed below.
+	// .json files may also carry per-domain settings.
+	var domains []string
+	overrides := make(map[string]*domainOverrides)
+	for _, inputFile := range readFiles {
+		if strings.EqualFold(filepath.Ext(inputFile), ".json") {
+			names, fileOverrides, err := readTargetFile(inputFile)
+			if err != nil {
+				logError(logFields{}, "Error: %v", err)
+				os.Exit(1)
+			}
+			domains = append(domains, names...)
+			for d, o := range fileOverrides {
+				overrides[d] = o
+			}
+			continue
+		}
+		names, err := readNameFile(inputFile)
+		if err != nil {
+			logError(logFields{}, "Error: %v", err)
+			os.Exit(1)
+		}
+		if *parseURLs {
+			for i, n := range names {
+				names[i] = urlHost(n)
+			}
+		}
+		domains = append(domains, names...)
+	}
+
+	// Opened only now, so the previous failures file can be one of the inputs
+	var failures *failureLog
+	if *failuresFile != "" {
+		failures, err = openFailureLog(*failuresFile)
+		if err != nil {
+			logError(logFields{}, "Error: %v", err)
+			os.Exit(1)
+		}
+		defer failures.close()
+	}
+
+	domains, duplicates, invalid := prepareDomains(domains)
+	if duplicates > 0 || invalid > 0 {
+		logInfo(logFields{}, "Removed %d duplicate and %d invalid input line(s)", duplicates, invalid)
+	}
+
+	if len(scope) > 0 {
+		inside := domains[:0]
+		for _, d := range domains {
+			if inScope(scope, d) {
+				inside = append(inside, d)
+			} else {
+				logWarn(logFields{Domain: d}, "Skipping out-of-scope domain %s", d)
+			}
+		}
+		domains = inside
+	}
+
+	// Start a fresh manifest unless resuming a previous run
+	state := &runState{path: *stateFile, completed: make(map[string]struct{})}
+	if *resume {
+		state, err = loadRunState(*stateFile)
+		if err != nil {
+			logError(logFields{}, "Error: %v", err)
+			os.Exit(1)
+		}
+		pending := domains[:0]
+		for _, d := range domains {
+			if !state.isCompleted(d) {
+				pending = append(pending, d)
+			}
+		}
+		if skipped := len(domains) - len(pending); skipped > 0 {
+			logInfo(logFields{}, "Resuming: skipping %d completed domain(s)", skipped)
+		}
+		domains = pending
+	}
+	// With -stream-input, finished domains are appended to the manifest
+	// instead of being remembered and rewritten after each one
+	if *streamInput && !*countOnly && !*probe {
+		if err := state.startAppend(); err != nil {
+			logError(logFields{}, "Error: %v", err)
+			os.Exit(1)
+		}
+		defer state.close()
+	}
+
+	if len(domains) == 0 && !*streamInput {
+		logInfo(logFields{}, "No domains to process.")
+		return
+	}
+
+	// Without directories, several domains' files would be hard to tell apart
+	if *flattenOutput && !*streamInput {
+		if len(domains) == 1 {
+			opts.flattenOutput = true
+		} else {
+			logWarn(logFields{}, "-flatten-output only applies to single-domain runs; writing %d domains to their own directories", len(domains))
+		}
+	}
+
+	// Spread load over unrelated zones and make partial runs representative
+	if *shuffle {
+		s := *seed
+		if s == 0 {
+			s = time.Now().UnixNano()
+		}
+		rand.New(rand.NewSource(s)).Shuffle(len(domains), func(i, j int) {
+			domains[i], domains[j] = domains[j], domains[i]
+		})
+		logInfo(logFields{}, "Shuffled %d domain(s) with -seed %d", len(domains), s)
+	}
+
+	ctx, cancel := startRun()
+	defer cancel()
+
+	// A live status line, only on an interactive terminal
+	var prog *progressLine
+	if !silent && !jsonLogs && stdoutIsTerminal() {
+		prog = startProgress(len(domains))
+	}
+
+	var succeeded, failed atomic.Int64
+
+	// With -retry-failed, the domains that failed in the current pass are
+	// kept for the next one, and only written to -failures once retries are
+	// over
+	type domainFailure struct {
+		domain string
+		err    error
+	}
+	var failedMu sync.Mutex
+	var failedPass []domainFailure
+
+	run := func(domain string) {
+		prog.started(domain)
+		defer prog.finished()
+		if err := processDomain(ctx, domain, overrides[domain].apply(opts)); err != nil {
+			logError(logFields{Domain: domain}, "Error processing %s: %v", domain, err)
+			if *retryFailed > 0 {
+				failedMu.Lock()
+				failedPass = append(failedPass, domainFailure{domain, err})
+				failedMu.Unlock()
+			} else {
+				failures.record(domain, err)
+			}
+			metrics.domainsFailed.Add(1)
+			if failed.Add(1) == 1 && *strict {
+				logError(logFields{Domain: domain}, "Error: stopping after first failure (-strict)")
+				cancel()
+			}
+			return
+		}
+		succeeded.Add(1)
+		metrics.domainsSucceeded.Add(1)
+		if *countOnly || *probe {
+			return
+		}
+		if err := state.markCompleted(domain); err != nil {
+			logError(logFields{Domain: domain}, "Error updating state file: %v", err)
+		}
+	}
+
+	// feed hands each domain to yield, in order, until yield returns false
+	feed := func(yield func(domain string) bool) {
+		for _, d := range domains {
+			if !yield(d) {
+				return
+			}
+		}
+	}
+	if *streamInput {
+		// Each line is cleaned up and filtered on its own; duplicates are
+		// not detected, since that would mean remembering every domain
+		feed = func(yield func(domain string) bool) {
+			err := streamNameFiles(inputFiles, func(line string) bool {
+				if *parseURLs {
+					line = urlHost(line)
+				}
+				names, _, _ := prepareDomains([]string{line})
+				if len(names) == 0 {
+					return true
+				}
+				d := names[0]
+				if len(scope) > 0 && !inScope(scope, d) {
+					logWarn(logFields{Domain: d}, "Skipping out-of-scope domain %s", d)
+					return true
+				}
+				if *resume && state.isCompleted(d) {
+					return true
+				}
+				return yield(d)
+			})
+			if err != nil {
+				logError(logFields{}, "Error: %v", err)
+				failed.Add(1)
+			}
+		}
+	}
+
+	// runPass processes every domain feed yields, sequentially or with the
+	// worker pool
+	runPass := func(feed func(yield func(domain string) bool)) {
+		if workers <= 1 {
+			// Sequential processing
+			feed(func(domain string) bool {
+				if ctx.Err() != nil {
+					return false
+				}
+				run(domain)
+				return true
+			})
+			return
+		}
+
+		// Concurrent processing with a worker pool
+		domainCh := make(chan string)
+		var wg sync.WaitGroup
+
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for domain := range domainCh {
+					run(domain)
+				}
+			}()
+		}
+
+		feed(func(d string) bool {
+			select {
+			case domainCh <- d:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+		close(domainCh)
+		wg.Wait()
+	}
+
+	if workers > 1 {
+		if autoWorkers {
+			logInfo(logFields{}, "Using up to %d workers, adapting to crt.sh throttling", workers)
+		} else {
+			logInfo(logFields{}, "Using %d workers", workers)
+		}
+	}
+	runPass(feed)
+
+	// -retry-failed: only the domains still failing carry into the next pass
+	firstFailed := len(failedPass)
+	for pass := 1; pass <= *retryFailed && len(failedPass) > 0 && ctx.Err() == nil; pass++ {
+		retry := failedPass
+		failedPass = nil
+		delay := retryFailedDelay << (pass - 1)
+		logInfo(logFields{}, "Retrying %d failed domain(s) in %s (pass %d of %d)", len(retry), delay, pass, *retryFailed)
+		sleepCtx(ctx, delay)
+
+		// Retried domains are counted again by the pass
+		failed.Add(-int64(len(retry)))
+		prog.requeued(len(retry))
+		next := 0
+		runPass(func(yield func(domain string) bool) {
+			for ; next < len(retry); next++ {
+				if !yield(retry[next].domain) {
+					return
+				}
+			}
+		})
+		// Domains the pass never got to, because the run was stopped, are
+		// still failed
+		failedPass = append(failedPass, retry[next:]...)
+		failed.Add(int64(len(retry) - next))
+	}
+	if firstFailed > 0 {
+		logInfo(logFields{}, "%d of %d failed domain(s) recovered on retry", firstFailed-len(failedPass), firstFailed)
+	}
+	for _, f := range failedPass {
+		failures.record(f.domain, f.err)
+	}
+
+	prog.stopProgress()
+
+	// Let -on-complete commands that are still running finish
+	opts.onComplete.wait()
+
+	if *countOnly {
+		c := opts.counts
+		emitResult(fmt.Sprintf("total: %d subdomains, %d wildcards across %d domain(s)", c.subs, c.wildcards, c.domains))
+	}
+
+	// The roots file belongs to the run, like the state file, so it's always local
+	if opts.roots != nil {
+		if err := writeSetSorted(localBackend{}, *emitRoots, opts.roots, opts.sortMode); err != nil {
+			logError(logFields{}, "Error: failed to write %s: %v", *emitRoots, err)
+		} else {
+			logInfo(logFields{}, "Wrote %d apex domain(s) to %s", opts.roots.Len(), *emitRoots)
+		}
+	}
+
+	code := exitOK
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		logError(logFields{}, "Error: maximum runtime of %s reached; run stopped early", *maxRuntime)
+		code = exitDeadline
+	case failed.Load() > 0 && succeeded.Load() == 0:
+		code = exitAllFailed
+	case failed.Load() > 0:
+		code = exitSomeFailed
+	}
+	if n, avg, peak := requestRates.summary(); n > 0 {
+		logInfo(logFields{}, "%d crt.sh request(s), %.2f per second on average, at most %d within one second", n, avg, peak)
+	}
+	if logFile != nil {
+		logInfo(logFields{}, "Run finished after %s: %d domain(s) succeeded, %d failed (exit code %d)", time.Since(started).Round(time.Second), succeeded.Load(), failed.Load(), code)
+	}
+	if code != exitOK {
+		logError(logFields{}, "%d domain(s) succeeded, %d failed", succeeded.Load(), failed.Load())
+		cancel()
+		os.Exit(code)
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeEntries(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    []int64 // IDs of the decoded entries
+		wantErr bool
+	}{
+		{
+			name: "clean array",
+			body: `[{"id":1,"name_value":"a.example.com"},{"id":2,"name_value":"b.example.com"}]`,
+			want: []int64{1, 2},
+		},
+		{
+			name:    "truncated array keeps the complete entries",
+			body:    `[{"id":1,"name_value":"a.example.com"},{"id":2,"name_value":"b.example.com"},{"id":3,"name_va`,
+			want:    []int64{1, 2},
+			wantErr: true,
+		},
+		{
+			name: "null",
+			body: `null`,
+		},
+		{
+			name: "empty array",
+			body: `[]`,
+		},
+		{
+			name:    "not an array",
+			body:    `{"error":"busy"}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := decodeEntries([]byte(tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			var ids []int64
+			for _, e := range entries {
+				ids = append(ids, e.ID)
+			}
+			if !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("IDs = %v, want %v", ids, tt.want)
+			}
+		})
+	}
+}
+
+func TestCRTEntryNamesDelimiters(t *testing.T) {
+	tests := []struct {
+		name      string
+		nameValue string
+		want      []string
+	}{
+		{"newlines", "a.example.com\nb.example.com", []string{"a.example.com", "b.example.com"}},
+		{"commas", "a.example.com,b.example.com", []string{"a.example.com", "b.example.com"}},
+		{"mixed", "a.example.com,b.example.com\n*.c.example.com", []string{"a.example.com", "b.example.com", "*.c.example.com"}},
+		{"empty tokens", "\na.example.com,,\n\nb.example.com,\n", []string{"a.example.com", "b.example.com"}},
+		{"only delimiters", ",\n,", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := CRTEntry{NameValue: tt.nameValue}.names(false)
+			if !sameStrings(got, tt.want) {
+				t.Errorf("names() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCRTEntryNamesCommonName(t *testing.T) {
+	tests := []struct {
+		name           string
+		entry          CRTEntry
+		withCommonName bool
+		want           []string
+	}{
+		{
+			name:           "CN differs from the SAN",
+			entry:          CRTEntry{NameValue: "www.example.com", CommonName: "legacy.example.com"},
+			withCommonName: true,
+			want:           []string{"www.example.com", "legacy.example.com"},
+		},
+		{
+			name:           "CN ignored with -no-common-name",
+			entry:          CRTEntry{NameValue: "www.example.com", CommonName: "legacy.example.com"},
+			withCommonName: false,
+			want:           []string{"www.example.com"},
+		},
+		{
+			name:           "CN that is not a hostname",
+			entry:          CRTEntry{NameValue: "www.example.com", CommonName: "Example Inc."},
+			withCommonName: true,
+			want:           []string{"www.example.com"},
+		},
+		{
+			name:           "wildcard CN",
+			entry:          CRTEntry{NameValue: "www.example.com", CommonName: "*.dev.example.com"},
+			withCommonName: true,
+			want:           []string{"www.example.com", "*.dev.example.com"},
+		},
+		{
+			name:           "no CN",
+			entry:          CRTEntry{NameValue: "www.example.com"},
+			withCommonName: true,
+			want:           []string{"www.example.com"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.entry.names(tt.withCommonName)
+			if !sameStrings(got, tt.want) {
+				t.Errorf("names() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsHTMLResponse(t *testing.T) {
+	const maintenance = `<!DOCTYPE html>
+<html><head><title>crt.sh | Certificate Search</title></head>
+<body>Sorry, something went wrong. Please try again later.</body></html>`
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        bool
+	}{
+		{"maintenance page", "text/html; charset=UTF-8", maintenance, true},
+		{"HTML served as JSON", "application/json", maintenance, true},
+		{"HTML without content type", "", "\n  <html><body>Bad Gateway</body></html>", true},
+		{"JSON array", "application/json", `[{"id":1,"name_value":"a.example.com"}]`, false},
+		{"empty array", "application/json", "[]", false},
+		{"empty body", "application/json", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isHTMLResponse(tt.contentType, []byte(tt.body)); got != tt.want {
+				t.Errorf("isHTMLResponse() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddEntriesWildcardsAsSubs(t *testing.T) {
+	entries := []CRTEntry{{ID: 1, NameValue: "www.example.com\n*.dev.example.com"}}
+	tests := []struct {
+		name            string
+		wildcardsAsSubs bool
+		wantSubs        []string
+	}{
+		{"off", false, []string{"www.example.com"}},
+		{"on", true, []string{"dev.example.com", "www.example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.wildcardsAsSubs = tt.wildcardsAsSubs
+			scan := newDomainScan("example.com", nil, false)
+			scan.addEntries("example.com", entries, opts)
+
+			if got := scan.subs.Sorted(); !sameStrings(got, tt.wantSubs) {
+				t.Errorf("subs = %q, want %q", got, tt.wantSubs)
+			}
+			// The root is always recorded and followed as a wildcard too
+			if got := scan.wildcards.Sorted(); !sameStrings(got, []string{"dev.example.com"}) {
+				t.Errorf("wildcards = %q, want [dev.example.com]", got)
+			}
+		})
+	}
+}
+
+func TestCleanNameTrailingDot(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"api.example.com.", "api.example.com"},
+		{"api.example.com", "api.example.com"},
+		{" API.Example.com.\r", "api.example.com"},
+		{"*.dev.example.com.", "*.dev.example.com"},
+		{"api.example.com..", "api.example.com."}, // only one dot is removed
+		{".", "."},
+	}
+	for _, tt := range tests {
+		if got := cleanName(tt.in); got != tt.want {
+			t.Errorf("cleanName(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestQueryCacheTrailingDot(t *testing.T) {
+	c := newQueryCache()
+	calls := 0
+	fetch := func() ([]CRTEntry, error) {
+		calls++
+		return []CRTEntry{{ID: 1, NameValue: "www.example.com"}}, nil
+	}
+
+	for i, name := range []string{"example.com", "example.com.", "Example.COM."} {
+		entries, hit, err := c.get(name, fetch)
+		if err != nil {
+			t.Fatalf("get(%q): %v", name, err)
+		}
+		if hit != (i > 0) {
+			t.Errorf("get(%q): hit = %v, want %v", name, hit, i > 0)
+		}
+		if len(entries) != 1 {
+			t.Errorf("get(%q): %d entries, want 1", name, len(entries))
+		}
+	}
+	if calls != 1 {
+		t.Errorf("fetch called %d times, want 1", calls)
+	}
+}
+
+// One failing seed must not throw away what the other seeds found; the
+// domain only fails when every seed does.
+func TestProcessDomainFailedSeeds(t *testing.T) {
+	tests := []struct {
+		name     string
+		fail     []string
+		wantErr  bool
+		wantSubs []string
+	}{
+		{"one seed fails", []string{"b.example.com"}, false, []string{"x.a.example.com"}},
+		{"all seeds fail", []string{"a.example.com", "b.example.com"}, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			src := &fakeSource{
+				entries: map[string][]CRTEntry{
+					"a.example.com": {{ID: 1, NameValue: "x.a.example.com"}},
+					"b.example.com": {{ID: 2, NameValue: "y.b.example.com"}},
+				},
+				fail: make(map[string]bool),
+			}
+			for _, f := range tt.fail {
+				src.fail[f] = true
+			}
+			opts := DefaultOptions()
+			opts.source = src
+			opts.seeds = []string{"a.example.com", "b.example.com"}
+
+			err := processDomain(context.Background(), "example.com", opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("processDomain() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			data, err := os.ReadFile(filepath.Join("example.com", "subs.txt"))
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("subs.txt written although every seed failed")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Fields(string(data)); !sameStrings(got, tt.wantSubs) {
+				t.Errorf("subs.txt = %q, want %q", got, tt.wantSubs)
+			}
+		})
+	}
+}
+
+// With -stream and -first-n, stdout stops after n names and subs.txt holds
+// exactly those.
+func TestStreamFirstN(t *testing.T) {
+	t.Chdir(t.TempDir())
+	opts := DefaultOptions()
+	opts.source = &fakeSource{entries: map[string][]CRTEntry{
+		"example.com": {{ID: 1, NameValue: "d.example.com\nc.example.com\nb.example.com\na.example.com"}},
+	}}
+	opts.stream = true
+	opts.firstN = 2
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	err = processDomain(context.Background(), "example.com", opts)
+	os.Stdout = stdout
+	w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	printed, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := strings.Fields(string(printed)), []string{"d.example.com", "c.example.com"}; !sameStrings(got, want) {
+		t.Errorf("stdout = %q, want %q", got, want)
+	}
+	data, err := os.ReadFile(filepath.Join("example.com", "subs.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Fields(string(data)), []string{"c.example.com", "d.example.com"}; !sameStrings(got, want) {
+		t.Errorf("subs.txt = %q, want %q", got, want)
+	}
+}
+
+// subs_sources.json is only written when no results file carries the sources.
+func TestSubsSourcesOnlyForTxt(t *testing.T) {
+	tests := []struct {
+		formats []string
+		want    bool
+	}{
+		{[]string{formatTxt}, true},
+		{[]string{formatTxt, formatJSON}, false},
+		{[]string{formatCSV}, false},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.formats, ","), func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			opts := DefaultOptions()
+			opts.source = &fakeSource{entries: map[string][]CRTEntry{
+				"example.com": {{ID: 1, NameValue: "a.example.com"}},
+			}}
+			opts.withSource = true
+			opts.formats = tt.formats
+			if err := processDomain(context.Background(), "example.com", opts); err != nil {
+				t.Fatal(err)
+			}
+			_, err := os.Stat(filepath.Join("example.com", "subs_sources.json"))
+			if got := err == nil; got != tt.want {
+				t.Errorf("subs_sources.json written = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeSource answers crt.sh queries from a fixed table, keyed by the queried
+// name, and fails the names in fail.
+type fakeSource struct {
+	entries map[string][]CRTEntry
+	fail    map[string]bool
+}
+
+func (s *fakeSource) id() sourceMask { return sourceCrtshAPI }
+
+func (s *fakeSource) fetch(ctx context.Context, opts *Options, domain, current, q string) ([]CRTEntry, error) {
+	if s.fail[current] {
+		return nil, errors.New("crt.sh unavailable")
+	}
+	return s.entries[current], nil
+}
+
+// sameStrings reports whether a and b hold the same strings in the same
+// order, treating nil and empty as equal.
+func sameStrings(a, b []string) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
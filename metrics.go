@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// runMetrics holds the counters exposed on -metrics-addr. They are updated
+// from every worker goroutine, so all fields are atomic or mutex-guarded.
+type runMetrics struct {
+	domainsSucceeded atomic.Int64
+	domainsFailed    atomic.Int64
+	queries          atomic.Int64
+	retries          atomic.Int64
+	requestErrors    atomic.Int64
+	subdomains       atomic.Int64
+
+	mu       sync.Mutex
+	statuses map[int]int64
+}
+
+var metrics runMetrics
+
+func (m *runMetrics) observeStatus(code int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.statuses == nil {
+		m.statuses = make(map[int]int64)
+	}
+	m.statuses[code]++
+}
+
+// writePrometheus writes all counters in the Prometheus text exposition format.
+func (m *runMetrics) writePrometheus(w io.Writer) {
+	counter := func(name, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	}
+
+	counter("crtsubfinder_domains_processed_total", "Input domains processed, by result.")
+	fmt.Fprintf(w, "crtsubfinder_domains_processed_total{result=\"success\"} %d\n", m.domainsSucceeded.Load())
+	fmt.Fprintf(w, "crtsubfinder_domains_processed_total{result=\"failed\"} %d\n", m.domainsFailed.Load())
+
+	counter("crtsubfinder_queries_total", "crt.sh queries issued (not counting retries).")
+	fmt.Fprintf(w, "crtsubfinder_queries_total %d\n", m.queries.Load())
+
+	counter("crtsubfinder_retries_total", "crt.sh requests retried after a failure.")
+	fmt.Fprintf(w, "crtsubfinder_retries_total %d\n", m.retries.Load())
+
+	counter("crtsubfinder_request_errors_total", "crt.sh requests that failed without an HTTP response.")
+	fmt.Fprintf(w, "crtsubfinder_request_errors_total %d\n", m.requestErrors.Load())
+
+	counter("crtsubfinder_http_responses_total", "crt.sh HTTP responses, by status code.")
+	m.mu.Lock()
+	codes := make([]int, 0, len(m.statuses))
+	for code := range m.statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Fprintf(w, "crtsubfinder_http_responses_total{code=\"%d\"} %d\n", code, m.statuses[code])
+	}
+	m.mu.Unlock()
+
+	counter("crtsubfinder_subdomains_found_total", "Unique subdomains found, summed over domains.")
+	fmt.Fprintf(w, "crtsubfinder_subdomains_found_total %d\n", m.subdomains.Load())
+}
+
+// serveMetrics exposes the counters at http://addr/metrics in the background.
+// It only fails if addr cannot be listened on.
+func serveMetrics(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.writePrometheus(w)
+	})
+
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			logError(logFields{}, "Error: metrics server stopped: %v", err)
+		}
+	}()
+	logInfo(logFields{}, "Serving metrics on http://%s/metrics", ln.Addr())
+	return nil
+}
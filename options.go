@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"time"
+)
+
+// Options holds the settings shared by every domain of a run. NewOptions
+// builds a checked one from the defaults; DefaultOptions returns the defaults
+// alone.
+type Options struct {
+	client            *http.Client
+	baseURL           string        // crt.sh or a mirror (-crtsh-url)
+	rateLimit         time.Duration // delay between crt.sh requests
+	maxRetries        int           // attempts per query
+	cache             *queryCache   // shared query results; nil unless -dedup-queries
+	skipDone          bool
+	withCertDetails   bool
+	withSource        bool // also write subs_sources.json
+	stream            bool
+	noRecurse         bool
+	noCommonName      bool // ignore common_name and only use name_value
+	maxDepth          int  // levels of wildcard roots to follow (-1 = unlimited)
+	workers           int  // domains scanned at once (-workers)
+	domainWorkers     int
+	exclude           []*regexp.Regexp
+	include           []*regexp.Regexp // nil unless -include
+	countOnly         bool
+	probe             bool          // one query per domain, reporting only whether crt.sh has data
+	resolver          *nameResolver // nil unless -resolve
+	firstN            int           // cap on names written to subs.txt (0 = no cap)
+	emptyRetries      int           // extra queries for empty answers (-retry-on-empty)
+	sampleRate        float64       // share of subdomains kept (-sample-rate; 1 = all)
+	sampleSeed        int64
+	counts            *resultCounts
+	queryMode         string
+	sortMode          string
+	appendMode        bool
+	excludeExpired    bool
+	scope             []*regexp.Regexp
+	scopeResults      bool
+	retryBudget       *retryBudget
+	limiter           *hostLimiter
+	includeApex       bool
+	wildcardsAsSubs   bool
+	sinceIDs          *sinceIDs
+	onComplete        *completionHook
+	source            certSource
+	flat              bool       // also write all.txt
+	flatOnly          bool       // write all.txt instead of the subs and wildcard files
+	roots             *StringSet // apex domains for -emit-roots; nil if not wanted
+	output            outputBackend
+	minResults        int
+	seeds             []string // -seed-file names; each domain starts from those below it
+	collapseWildcards bool
+	trimWWW           bool     // drop "www.X" when X was found too
+	skipApexOnly      bool     // ignore query results that only name the queried name
+	flattenOutput     bool     // single domain: write "domain-subs.txt" etc. instead of a directory
+	formats           []string // -format, in the order given
+	// File names inside each domain directory (-subs-filename, -wildcards-filename)
+	subsFilename      string
+	wildcardsFilename string
+}
+
+// outputName returns the name of one of domain's output files: file inside
+// the domain directory, or "domain-file" in the current directory with
+// -flatten-output.
+func (opts *Options) outputName(domain, file string) string {
+	if opts.flattenOutput {
+		return domain + "-" + file
+	}
+	return path.Join(domain, file)
+}
+
+// NewOptions returns the defaults with set applied to them, or the first
+// problem Validate finds in the result. set may be nil.
+func NewOptions(set func(*Options)) (*Options, error) {
+	opts := DefaultOptions()
+	if set != nil {
+		set(opts)
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+// DefaultOptions returns Options with the defaults of the command-line flags:
+// the crt.sh JSON API, one second between requests, three attempts per query,
+// unlimited depth and subs.txt/wildcards_clean.txt in local directories. main
+// takes its flag defaults from here. Callers that change fields must call
+// Validate before using the Options.
+func DefaultOptions() *Options {
+	return &Options{
+		client:            &http.Client{Timeout: 20 * time.Second},
+		baseURL:           defaultCrtshURL,
+		rateLimit:         time.Second,
+		maxRetries:        3,
+		skipDone:          true,
+		maxDepth:          -1,
+		workers:           1,
+		domainWorkers:     1,
+		sampleRate:        1,
+		counts:            &resultCounts{},
+		queryMode:         queryModeWildcard,
+		sortMode:          sortLex,
+		source:            &httpSource{},
+		output:            localBackend{},
+		formats:           []string{formatTxt},
+		subsFilename:      "subs.txt",
+		wildcardsFilename: "wildcards_clean.txt",
+	}
+}
+
+// Validate reports the first setting that is out of range or inconsistent.
+// Errors name the flag that controls the setting.
+func (opts *Options) Validate() error {
+	if opts.client == nil || opts.source == nil || opts.output == nil {
+		return errors.New("options need a client, a source and an output; use NewOptions")
+	}
+	if opts.maxRetries < 1 {
+		return errors.New("-retries must be at least 1")
+	}
+	if opts.sampleRate <= 0 || opts.sampleRate > 1 {
+		return errors.New("-sample-rate must be greater than 0 and at most 1")
+	}
+
+	switch opts.queryMode {
+	case queryModeWildcard, queryModeExact, queryModeBoth:
+	default:
+		return fmt.Errorf("-query-mode must be %q, %q or %q", queryModeWildcard, queryModeExact, queryModeBoth)
+	}
+	if opts.sortMode != sortLex && opts.sortMode != sortReverse {
+		return fmt.Errorf("-sort must be %q or %q", sortLex, sortReverse)
+	}
+
+	if len(opts.formats) == 0 {
+		return errors.New("-format: no format given")
+	}
+	for _, f := range opts.formats {
+		switch f {
+		case formatTxt, formatJSON, formatCSV:
+		default:
+			return fmt.Errorf("-format: unknown format %q (want txt, json or csv)", f)
+		}
+	}
+
+	for _, f := range []struct{ flag, name string }{
+		{"subs-filename", opts.subsFilename},
+		{"wildcards-filename", opts.wildcardsFilename},
+	} {
+		if err := validatePathElement(f.name); err != nil {
+			return fmt.Errorf("-%s: %w", f.flag, err)
+		}
+	}
+	if opts.subsFilename == opts.wildcardsFilename {
+		return errors.New("-subs-filename and -wildcards-filename must differ")
+	}
+	for _, name := range []string{opts.subsFilename, opts.wildcardsFilename} {
+		if name == "wildcards_external.txt" || name == "subs.json" || name == "all.txt" || name == "resolved.txt" || name == "subs_sources.json" || name == doneMarker ||
+			name == resultsFile(formatJSON) || name == resultsFile(formatCSV) {
+			return fmt.Errorf("%s is already used for another output file", name)
+		}
+	}
+	return nil
+}
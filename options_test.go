@@ -0,0 +1,43 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNewOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		set     func(*Options)
+		wantErr string // substring; "" = valid
+	}{
+		{name: "defaults"},
+		{name: "formats", set: func(o *Options) { o.formats = splitFormats("JSON, txt,json") }},
+		{name: "unknown format", set: func(o *Options) { o.formats = splitFormats("txt,xml") }, wantErr: `unknown format "xml"`},
+		{name: "no format", set: func(o *Options) { o.formats = splitFormats(" , ") }, wantErr: "no format given"},
+		{name: "bad sort", set: func(o *Options) { o.sortMode = "size" }, wantErr: "-sort"},
+		{name: "no retries", set: func(o *Options) { o.maxRetries = 0 }, wantErr: "-retries"},
+		{name: "same file names", set: func(o *Options) { o.wildcardsFilename = o.subsFilename }, wantErr: "must differ"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := NewOptions(tt.set)
+			if tt.wantErr == "" {
+				if err != nil || opts == nil {
+					t.Fatalf("NewOptions() = %v, %v; want options", opts, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("NewOptions() error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSplitFormats(t *testing.T) {
+	if got, want := splitFormats("JSON, txt,,json"), []string{formatJSON, formatTxt}; !reflect.DeepEqual(got, want) {
+		t.Errorf("splitFormats() = %q, want %q", got, want)
+	}
+}
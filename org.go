@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// runOrg queries crt.sh for certificates whose subject organization is org
+// and writes every name found into a directory named after the organization.
+// Wildcard roots are recorded but not followed, since they are not tied to a
+// single input domain.
+func runOrg(ctx context.Context, org string, opts *Options) error {
+	dir := orgDirName(org)
+	lf := logFields{Domain: org}
+	if err := validatePathElement(dir); err != nil {
+		return fmt.Errorf("refusing to use %q as output directory: %w", dir, err)
+	}
+	logInfo(lf, "Processing organization: %s", org)
+
+	entries, err := queryCrt(ctx, opts, org, org, "O", org)
+	if err != nil {
+		return fmt.Errorf("crt.sh query for organization %q failed: %w", org, err)
+	}
+
+	scan := newDomainScan(dir, nil, opts.withCertDetails)
+	if opts.withSource {
+		scan.sources = make(map[string]sourceMask)
+	}
+	scan.addEntries(dir, entries, opts)
+	if opts.collapseWildcards {
+		scan.wildcards = collapseWildcards(scan.wildcards)
+	}
+	if opts.trimWWW {
+		scan.subs = trimWWW(scan.subs)
+	}
+
+	if opts.countOnly {
+		emitResult(fmt.Sprintf("%s: %d subdomains, %d wildcards", org, scan.subs.Len(), scan.wildcards.Len()))
+		return nil
+	}
+
+	// The same files as for a domain, except wildcards_external.txt: no
+	// root belongs to the organization's directory name
+	if err := writeDomainFiles(lf, dir, scan, opts, false); err != nil {
+		return err
+	}
+
+	logSuccess(lf, "Found %d subdomains and %d wildcard roots for %s → %s/", scan.subs.Len(), scan.wildcards.Len(), org, dirLocation(opts.output, dir))
+	return nil
+}
+
+// orgDirName turns an organization name into a directory name, e.g.
+// "Example Inc." becomes "org_Example_Inc".
+func orgDirName(org string) string {
+	var sb strings.Builder
+	for _, c := range strings.TrimSpace(org) {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-':
+			sb.WriteRune(c)
+		default:
+			sb.WriteByte('_')
+		}
+	}
+	return "org_" + strings.Trim(sb.String(), "_")
+}
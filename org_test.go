@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// -org output goes through the same options as a domain's: -format and
+// -first-n here.
+func TestRunOrgFormats(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"id":1,"name_value":"b.example.com\na.example.com\n*.c.example.com"}]`))
+	}))
+	defer srv.Close()
+	t.Chdir(t.TempDir())
+
+	opts := DefaultOptions()
+	opts.baseURL = srv.URL + "/"
+	opts.rateLimit = 0
+	opts.formats = []string{formatCSV}
+	opts.firstN = 1
+	if err := runOrg(context.Background(), "Example Inc", opts); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join("org_Example_Inc", "results.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "name,type\na.example.com,subdomain\nc.example.com,wildcard\n"; string(data) != want {
+		t.Errorf("results.csv = %q, want %q", data, want)
+	}
+	if _, err := os.Stat(filepath.Join("org_Example_Inc", "subs.txt")); err == nil {
+		t.Errorf("subs.txt written without txt in -format")
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// outputBackend stores result files. Names are slash-separated paths
+// relative to the output root, such as "example.com/subs.txt".
+type outputBackend interface {
+	WriteFile(name string, data []byte) error
+	// ReadFile returns an error wrapping os.ErrNotExist if name is missing.
+	ReadFile(name string) ([]byte, error)
+	// Size returns the size of name, or an error wrapping os.ErrNotExist.
+	Size(name string) (int64, error)
+	// Location describes where name is stored, for log messages.
+	Location(name string) string
+}
+
+// localBackend writes results below the current directory. It is the default.
+type localBackend struct{}
+
+func (localBackend) WriteFile(name string, data []byte) error {
+	path := filepath.FromSlash(name)
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("failed to create directory '%s': %w", dir, err)
+		}
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+func (localBackend) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(filepath.FromSlash(name))
+}
+
+func (localBackend) Size(name string) (int64, error) {
+	info, err := os.Stat(filepath.FromSlash(name))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (localBackend) Location(name string) string {
+	return filepath.FromSlash(name)
+}
+
+// gzipBackend compresses every file it stores with gzip and adds ".gz" to
+// its name. Callers keep using the plain names.
+type gzipBackend struct {
+	inner outputBackend
+}
+
+func (b gzipBackend) WriteFile(name string, data []byte) error {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return b.inner.WriteFile(name+".gz", buf.Bytes())
+}
+
+func (b gzipBackend) ReadFile(name string) ([]byte, error) {
+	data, err := b.inner.ReadFile(name + ".gz")
+	if err != nil {
+		return nil, err
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", b.Location(name), err)
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
+// Size reports the uncompressed size, so that an empty list still counts as
+// empty for -skip-done even though its .gz file is not.
+func (b gzipBackend) Size(name string) (int64, error) {
+	data, err := b.ReadFile(name)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(data)), nil
+}
+
+func (b gzipBackend) Location(name string) string {
+	return b.inner.Location(name + ".gz")
+}
+
+// dirLocation describes where the files below dir are stored, for log
+// messages and hooks. Unlike Location it never adds a file extension.
+func dirLocation(out outputBackend, dir string) string {
+	if g, ok := out.(gzipBackend); ok {
+		out = g.inner
+	}
+	return out.Location(dir)
+}
+
+// validatePathElement checks that name is a single path element that cannot
+// escape the directory it is joined to. It is applied to user-supplied file
+// names and to every directory name derived from input or crt.sh data, since
+// those end up in MkdirAll and Create calls.
+func validatePathElement(name string) error {
+	if name == "" || name == "." || name == ".." {
+		return fmt.Errorf("invalid path element %q", name)
+	}
+	if strings.ContainsAny(name, "/\\\x00") || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return fmt.Errorf("path element %q must not contain path separators or NUL bytes", name)
+	}
+	return nil
+}
+
+// Output orderings selected with -sort.
+const (
+	sortLex     = "lex"     // plain lexicographic order
+	sortReverse = "reverse" // by reversed labels, grouping hosts under their parents
+)
+
+// sortNames sorts names in place according to mode. Every list of names the
+// tool outputs is ordered through here (or sortedSet), so -sort applies to
+// all of them alike.
+func sortNames(names []string, mode string) {
+	if mode != sortReverse {
+		sort.Strings(names)
+		return
+	}
+
+	// Compare label by label from the right, so that "a.b.example.com" and
+	// "c.b.example.com" end up next to each other, right after "b.example.com".
+	labels := make(map[string][]string, len(names))
+	for _, n := range names {
+		labels[n] = strings.Split(n, ".")
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := labels[names[i]], labels[names[j]]
+		for x, y := len(a)-1, len(b)-1; x >= 0 && y >= 0; x, y = x-1, y-1 {
+			if a[x] != b[y] {
+				return a[x] < b[y]
+			}
+		}
+		return len(a) < len(b)
+	})
+}
+
+// sortedSet returns the names in set ordered according to mode.
+func sortedSet(set *StringSet, mode string) []string {
+	names := set.Sorted()
+	if mode != sortLex {
+		sortNames(names, mode)
+	}
+	return names
+}
+
+// firstN returns the first n names of set in the order given by mode, or set
+// itself if it holds no more than n names or n is not positive.
+func firstN(set *StringSet, n int, mode string) *StringSet {
+	if n <= 0 || set.Len() <= n {
+		return set
+	}
+	out := NewStringSet()
+	for _, name := range sortedSet(set, mode)[:n] {
+		out.Add(name)
+	}
+	return out
+}
+
+func writeSetSorted(out outputBackend, name string, set *StringSet, sortMode string) error {
+	items := sortedSet(set, sortMode)
+
+	var buf bytes.Buffer
+	for _, v := range items {
+		buf.WriteString(v)
+		buf.WriteByte('\n')
+	}
+	return out.WriteFile(name, buf.Bytes())
+}
+
+// writeCertDetails writes one JSON object per subdomain in subs that has
+// certificate details, in the same order as subs.txt. Names dropped from
+// subs after the scan, e.g. by -trim-www or -first-n, are left out too.
+func writeCertDetails(out outputBackend, name string, subs *StringSet, certs map[string]CertDetails, sortMode string) error {
+	list := make([]CertDetails, 0, len(certs))
+	for _, n := range sortedSet(subs, sortMode) {
+		if d, ok := certs[n]; ok {
+			list = append(list, d)
+		}
+	}
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return out.WriteFile(name, append(data, '\n'))
+}
+
+// mergeExisting adds the names already stored in name, if it exists, to set.
+func mergeExisting(out outputBackend, name string, set *StringSet) error {
+	data, err := out.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	names, err := parseNames(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	for _, n := range names {
+		set.Add(n)
+	}
+	return nil
+}
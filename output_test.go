@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// subs.txt and wildcards_clean.txt written by processDomain must list the
+// names they share in the same order for each -sort.
+func TestProcessDomainSameOrder(t *testing.T) {
+	for _, mode := range []string{sortLex, sortReverse} {
+		t.Run(mode, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			opts := DefaultOptions()
+			opts.source = &fakeSource{entries: map[string][]CRTEntry{
+				"example.com": {
+					{ID: 1, NameValue: "*.mail.example.com\n*.api.example.com\n*.zz.example.com\n*.a.zz.example.com"},
+					{ID: 2, NameValue: "mail.example.com\napi.example.com\nzz.example.com\na.zz.example.com\nwww.example.com"},
+				},
+			}}
+			opts.sortMode = mode
+
+			if err := processDomain(context.Background(), "example.com", opts); err != nil {
+				t.Fatal(err)
+			}
+			subs := readLines(t, filepath.Join("example.com", "subs.txt"))
+			wildcards := readLines(t, filepath.Join("example.com", "wildcards_clean.txt"))
+
+			want := []string{"a.zz.example.com", "api.example.com", "mail.example.com", "zz.example.com"}
+			sortNames(want, mode)
+			if !sameStrings(wildcards, want) {
+				t.Errorf("wildcards_clean.txt = %q, want %q", wildcards, want)
+			}
+			inWildcards := make(map[string]bool)
+			for _, w := range wildcards {
+				inWildcards[w] = true
+			}
+			var shared []string
+			for _, s := range subs {
+				if inWildcards[s] {
+					shared = append(shared, s)
+				}
+			}
+			if !sameStrings(shared, wildcards) {
+				t.Errorf("subs.txt lists the wildcard roots as %q, wildcards_clean.txt as %q", shared, wildcards)
+			}
+		})
+	}
+}
+
+// readLines returns the lines of the file at path.
+func readLines(t *testing.T, path string) []string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+// subs.json must list the same names as subs.txt: nothing dropped by
+// -exclude, and nothing cut by -first-n.
+func TestWriteCertDetailsMatchesSubs(t *testing.T) {
+	exclude, err := parsePatterns("www.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := DefaultOptions()
+	opts.exclude = exclude
+	scan := newDomainScan("example.com", nil, true)
+	scan.addEntries("example.com", []CRTEntry{
+		{ID: 1, NameValue: "www.example.com\napi.example.com\nmail.example.com"},
+	}, opts)
+	if _, ok := scan.certs["www.example.com"]; ok {
+		t.Errorf("cert details recorded for excluded www.example.com")
+	}
+
+	scan.subs = firstN(scan.subs, 1, sortLex)
+	path := filepath.Join(t.TempDir(), "subs.json")
+	if err := writeCertDetails(localBackend{}, path, scan.subs, scan.certs, sortLex); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []CertDetails
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Name != "api.example.com" {
+		t.Errorf("subs.json = %+v, want only api.example.com", got)
+	}
+}
+
+func TestValidatePathElement(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{"example.com", false},
+		{"subs.txt", false},
+		{"xn--mnchen-3ya.de", false},
+		{"", true},
+		{".", true},
+		{"..", true},
+		{"../etc", true},
+		{"../../.ssh/authorized_keys", true},
+		{"a/b", true},
+		{`..\windows`, true},
+		{"/etc/passwd", true},
+		{"C:evil", runtime.GOOS == "windows"},
+		{"evil\x00.txt", true},
+	}
+	for _, tt := range tests {
+		if err := validatePathElement(tt.name); (err != nil) != tt.wantErr {
+			t.Errorf("validatePathElement(%q) = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// crt.sh's public, read-only PostgreSQL endpoint.
+const defaultPostgresAddr = "crt.sh:5432"
+
+// crtPostgresQuery returns the same columns as the JSON API. $1 is the name
+// (for the full-text index), $2 the LIKE pattern and $3 whether to skip
+// expired certificates.
+const crtPostgresQuery = `SELECT cai.certificate_id,
+	coalesce(ca.name, ''),
+	string_agg(DISTINCT lower(cai.name_value), chr(10)),
+	x509_notBefore(cai.certificate),
+	x509_notAfter(cai.certificate)
+FROM certificate_and_identities cai
+LEFT JOIN ca ON ca.id = cai.issuer_ca_id
+WHERE plainto_tsquery('certwatch', $1) @@ identities(cai.certificate)
+	AND cai.name_type IN ('2.5.4.3', 'san:dNSName')
+	AND lower(cai.name_value) LIKE $2
+	AND (NOT $3::boolean OR x509_notAfter(cai.certificate) > now() AT TIME ZONE 'UTC')
+GROUP BY cai.certificate_id, cai.certificate, ca.name`
+
+// postgresSource queries crt.sh's database directly, which copes with large
+// result sets much better than the JSON API. It speaks just enough of the
+// PostgreSQL wire protocol for that, so no driver dependency is needed.
+type postgresSource struct {
+	addr     string
+	user     string
+	database string
+	password string
+	timeout  time.Duration
+}
+
+func (s *postgresSource) id() sourceMask { return sourceCrtshDB }
+
+func (s *postgresSource) fetch(ctx context.Context, opts *Options, domain, current, q string) ([]CRTEntry, error) {
+	lf := logFields{Domain: domain, Query: current}
+	logInfo(lf, "Querying crt.sh database for %s", strings.Replace(q, "%.", "*.", 1))
+
+	name := strings.TrimPrefix(q, "%.")
+	pattern := likeEscape(name)
+	if name != q {
+		pattern = "%." + pattern
+	}
+	expired := "false"
+	if opts.excludeExpired {
+		expired = "true"
+	}
+
+	var lastErr error
+	metrics.queries.Add(1)
+	for attempt := 1; attempt <= opts.maxRetries; attempt++ {
+		if attempt > 1 {
+			metrics.retries.Add(1)
+		}
+		host, _, _ := net.SplitHostPort(s.addr)
+		release, err := opts.limiter.acquire(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		rows, err := s.query(ctx, crtPostgresQuery, name, pattern, expired)
+		if err != nil {
+			release(0)
+		} else {
+			release(http.StatusOK)
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err == nil {
+			entries, err := entriesFromRows(rows)
+			if err == nil {
+				sleepCtx(ctx, opts.rateLimit)
+				return entries, nil
+			}
+			lastErr = err
+		} else {
+			lastErr = err
+			metrics.requestErrors.Add(1)
+		}
+		logAttemptFailure(logFields{Domain: domain, Query: current, Attempt: attempt}, "Database query for %s failed (attempt %d/%d): %v", current, attempt, opts.maxRetries, lastErr)
+		if attempt < opts.maxRetries && !opts.retryBudget.take() {
+			logWarn(lf, "Retry budget exhausted; not retrying %s", current)
+			break
+		}
+		sleepCtx(ctx, opts.rateLimit)
+	}
+	logWarn(lf, "Giving up on %s (last error: %v)", current, lastErr)
+	return nil, lastErr
+}
+
+// likeEscape escapes the LIKE metacharacters in s.
+func likeEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// entriesFromRows converts rows of crtPostgresQuery into entries.
+func entriesFromRows(rows [][]*string) ([]CRTEntry, error) {
+	entries := make([]CRTEntry, 0, len(rows))
+	for _, row := range rows {
+		if len(row) != 5 || row[0] == nil {
+			return nil, fmt.Errorf("unexpected row shape from database")
+		}
+		id, err := strconv.ParseInt(*row[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificate ID %q", *row[0])
+		}
+		e := CRTEntry{ID: id}
+		for i, dst := range []*string{&e.IssuerName, &e.NameValue, &e.NotBefore, &e.NotAfter} {
+			if row[i+1] != nil {
+				*dst = *row[i+1]
+			}
+		}
+		// Match the JSON API's timestamp format
+		e.NotBefore = strings.Replace(e.NotBefore, " ", "T", 1)
+		e.NotAfter = strings.Replace(e.NotAfter, " ", "T", 1)
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// query runs sql with text parameters over a new connection and returns the
+// rows as text, with nil for NULL.
+func (s *postgresSource) query(ctx context.Context, sql string, params ...string) ([][]*string, error) {
+	var d net.Dialer
+	dialCtx := ctx
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	conn, err := d.DialContext(dialCtx, "tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if s.timeout > 0 {
+		conn.SetDeadline(time.Now().Add(s.timeout))
+	}
+	// Unblock reads and writes if the run is cancelled
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	pc := &pgConn{r: bufio.NewReader(conn), w: conn}
+	if err := pc.startup(s.user, s.database, s.password); err != nil {
+		return nil, err
+	}
+	rows, err := pc.extendedQuery(sql, params)
+	pc.send('X', nil) // Terminate
+	return rows, err
+}
+
+// pgConn is a minimal PostgreSQL protocol (version 3) client connection.
+type pgConn struct {
+	r *bufio.Reader
+	w io.Writer
+}
+
+func (c *pgConn) send(typ byte, body []byte) error {
+	msg := make([]byte, 0, 5+len(body))
+	if typ != 0 {
+		msg = append(msg, typ)
+	}
+	msg = binary.BigEndian.AppendUint32(msg, uint32(4+len(body)))
+	msg = append(msg, body...)
+	_, err := c.w.Write(msg)
+	return err
+}
+
+func (c *pgConn) receive() (byte, []byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[1:])
+	if n < 4 || n > 64<<20 {
+		return 0, nil, fmt.Errorf("invalid message length %d", n)
+	}
+	body := make([]byte, n-4)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return 0, nil, err
+	}
+	return hdr[0], body, nil
+}
+
+func (c *pgConn) startup(user, database, password string) error {
+	var body []byte
+	body = binary.BigEndian.AppendUint32(body, 196608) // protocol 3.0
+	for _, kv := range [][2]string{{"user", user}, {"database", database}, {"application_name", "crt-subfinder"}} {
+		body = append(body, kv[0]...)
+		body = append(body, 0)
+		body = append(body, kv[1]...)
+		body = append(body, 0)
+	}
+	body = append(body, 0)
+	if err := c.send(0, body); err != nil {
+		return err
+	}
+
+	for {
+		typ, msg, err := c.receive()
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case 'R':
+			if len(msg) < 4 {
+				return errors.New("short authentication message")
+			}
+			switch binary.BigEndian.Uint32(msg) {
+			case 0: // AuthenticationOk
+			case 3: // cleartext password
+				if err := c.send('p', append([]byte(password), 0)); err != nil {
+					return err
+				}
+			case 5: // MD5 password
+				if len(msg) < 8 {
+					return errors.New("short MD5 authentication message")
+				}
+				inner := md5.Sum([]byte(password + user))
+				outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), msg[4:8]...))
+				if err := c.send('p', append([]byte("md5"+hex.EncodeToString(outer[:])), 0)); err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("unsupported authentication method %d", binary.BigEndian.Uint32(msg))
+			}
+		case 'E':
+			return pgError(msg)
+		case 'Z': // ReadyForQuery
+			return nil
+		}
+		// ParameterStatus, BackendKeyData and notices are ignored
+	}
+}
+
+// extendedQuery runs sql with text parameters using the extended query
+// protocol, so parameters are never interpolated into the SQL.
+func (c *pgConn) extendedQuery(sql string, params []string) ([][]*string, error) {
+	var parse []byte
+	parse = append(parse, 0) // unnamed statement
+	parse = append(parse, sql...)
+	parse = append(parse, 0)
+	parse = binary.BigEndian.AppendUint16(parse, 0) // let the server infer parameter types
+
+	var bind []byte
+	bind = append(bind, 0, 0)                     // unnamed portal and statement
+	bind = binary.BigEndian.AppendUint16(bind, 0) // all parameters in text format
+	bind = binary.BigEndian.AppendUint16(bind, uint16(len(params)))
+	for _, p := range params {
+		bind = binary.BigEndian.AppendUint32(bind, uint32(len(p)))
+		bind = append(bind, p...)
+	}
+	bind = binary.BigEndian.AppendUint16(bind, 0) // all results in text format
+
+	execute := binary.BigEndian.AppendUint32([]byte{0}, 0) // unnamed portal, no row limit
+
+	for _, m := range []struct {
+		typ  byte
+		body []byte
+	}{{'P', parse}, {'B', bind}, {'E', execute}, {'S', nil}} {
+		if err := c.send(m.typ, m.body); err != nil {
+			return nil, err
+		}
+	}
+
+	var rows [][]*string
+	var queryErr error
+	for {
+		typ, msg, err := c.receive()
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case 'D':
+			row, err := parseDataRow(msg)
+			if err != nil {
+				return nil, err
+			}
+			rows = append(rows, row)
+		case 'E':
+			queryErr = pgError(msg)
+		case 'Z': // ReadyForQuery, after Sync
+			if queryErr != nil {
+				return nil, queryErr
+			}
+			return rows, nil
+		}
+		// ParseComplete, BindComplete, CommandComplete and notices are ignored
+	}
+}
+
+func parseDataRow(msg []byte) ([]*string, error) {
+	if len(msg) < 2 {
+		return nil, errors.New("short data row")
+	}
+	n := int(binary.BigEndian.Uint16(msg))
+	msg = msg[2:]
+	row := make([]*string, n)
+	for i := range row {
+		if len(msg) < 4 {
+			return nil, errors.New("short data row")
+		}
+		size := int32(binary.BigEndian.Uint32(msg))
+		msg = msg[4:]
+		if size < 0 {
+			continue // NULL
+		}
+		if int(size) > len(msg) {
+			return nil, errors.New("short data row")
+		}
+		v := string(msg[:size])
+		row[i] = &v
+		msg = msg[size:]
+	}
+	return row, nil
+}
+
+// pgError formats an ErrorResponse message.
+func pgError(msg []byte) error {
+	fields := make(map[byte]string)
+	for len(msg) > 1 {
+		typ := msg[0]
+		end := 1
+		for end < len(msg) && msg[end] != 0 {
+			end++
+		}
+		fields[typ] = string(msg[1:end])
+		if end >= len(msg) {
+			break
+		}
+		msg = msg[end+1:]
+	}
+	return fmt.Errorf("postgres: %s: %s (SQLSTATE %s)", fields['S'], fields['M'], fields['C'])
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// pgMessage frames body as a backend message of type typ.
+func pgMessage(typ byte, body []byte) []byte {
+	msg := []byte{typ}
+	msg = binary.BigEndian.AppendUint32(msg, uint32(4+len(body)))
+	return append(msg, body...)
+}
+
+// pgDataRow builds a DataRow body; nil values are NULL.
+func pgDataRow(values ...*string) []byte {
+	body := binary.BigEndian.AppendUint16(nil, uint16(len(values)))
+	for _, v := range values {
+		if v == nil {
+			body = binary.BigEndian.AppendUint32(body, 0xFFFFFFFF)
+			continue
+		}
+		body = binary.BigEndian.AppendUint32(body, uint32(len(*v)))
+		body = append(body, *v...)
+	}
+	return body
+}
+
+// pgErrorBody builds an ErrorResponse body from field type/value pairs.
+func pgErrorBody(fields ...string) []byte {
+	var body []byte
+	for i := 0; i+1 < len(fields); i += 2 {
+		body = append(body, fields[i][0])
+		body = append(body, fields[i+1]...)
+		body = append(body, 0)
+	}
+	return append(body, 0)
+}
+
+func strPtr(s string) *string { return &s }
+
+// pgFrontend splits what the client wrote into message types and bodies.
+func pgFrontend(t *testing.T, data []byte) (types []byte, bodies [][]byte) {
+	t.Helper()
+	for len(data) > 0 {
+		if len(data) < 5 {
+			t.Fatalf("short frontend message %q", data)
+		}
+		n := int(binary.BigEndian.Uint32(data[1:5]))
+		types = append(types, data[0])
+		bodies = append(bodies, data[5:1+n])
+		data = data[1+n:]
+	}
+	return types, bodies
+}
+
+func TestParseDataRow(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     []byte
+		want    []*string
+		wantErr bool
+	}{
+		{"values", pgDataRow(strPtr("42"), strPtr("a.example.com")), []*string{strPtr("42"), strPtr("a.example.com")}, false},
+		{"NULL and empty", pgDataRow(nil, strPtr("")), []*string{nil, strPtr("")}, false},
+		{"no columns", pgDataRow(), []*string{}, false},
+		{"missing column count", []byte{0}, nil, true},
+		{"missing length", []byte{0, 1, 0, 0}, nil, true},
+		{"value cut off", append(binary.BigEndian.AppendUint32([]byte{0, 1}, 10), "short"...), nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseDataRow(tt.msg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseDataRow() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPgError(t *testing.T) {
+	err := pgError(pgErrorBody("S", "ERROR", "C", "57014", "M", "canceling statement due to statement timeout"))
+	want := "postgres: ERROR: canceling statement due to statement timeout (SQLSTATE 57014)"
+	if err.Error() != want {
+		t.Errorf("pgError() = %q, want %q", err, want)
+	}
+
+	// Missing fields and a missing terminator don't panic
+	if err := pgError([]byte("Mno terminator")); !strings.Contains(err.Error(), "no terminator") {
+		t.Errorf("pgError() = %q, want the message kept", err)
+	}
+}
+
+func TestEntriesFromRows(t *testing.T) {
+	rows := [][]*string{
+		{strPtr("123"), strPtr("C=US, O=Let's Encrypt, CN=R3"), strPtr("a.example.com\nb.example.com"), strPtr("2024-01-10 12:00:00"), strPtr("2024-04-09 12:00:00")},
+		{strPtr("124"), nil, strPtr("c.example.com"), nil, nil},
+	}
+	got, err := entriesFromRows(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []CRTEntry{
+		{ID: 123, IssuerName: "C=US, O=Let's Encrypt, CN=R3", NameValue: "a.example.com\nb.example.com", NotBefore: "2024-01-10T12:00:00", NotAfter: "2024-04-09T12:00:00"},
+		{ID: 124, NameValue: "c.example.com"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("entriesFromRows() = %+v, want %+v", got, want)
+	}
+
+	for name, rows := range map[string][][]*string{
+		"short row":  {{strPtr("1"), nil}},
+		"NULL ID":    {{nil, nil, nil, nil, nil}},
+		"invalid ID": {{strPtr("x"), nil, nil, nil, nil}},
+	} {
+		if _, err := entriesFromRows(rows); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestExtendedQuery(t *testing.T) {
+	var stream []byte
+	stream = append(stream, pgMessage('1', nil)...) // ParseComplete
+	stream = append(stream, pgMessage('2', nil)...) // BindComplete
+	stream = append(stream, pgMessage('D', pgDataRow(strPtr("1"), nil))...)
+	stream = append(stream, pgMessage('N', pgErrorBody("S", "NOTICE", "M", "ignored"))...)
+	stream = append(stream, pgMessage('D', pgDataRow(strPtr("2"), strPtr("b")))...)
+	stream = append(stream, pgMessage('C', []byte("SELECT 2\x00"))...)
+	stream = append(stream, pgMessage('Z', []byte{'I'})...)
+
+	var sent bytes.Buffer
+	c := &pgConn{r: bufio.NewReader(bytes.NewReader(stream)), w: &sent}
+	rows, err := c.extendedQuery("SELECT $1, $2", []string{"example.com", "%.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]*string{{strPtr("1"), nil}, {strPtr("2"), strPtr("b")}}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("rows = %v, want %v", rows, want)
+	}
+
+	types, bodies := pgFrontend(t, sent.Bytes())
+	if string(types) != "PBES" {
+		t.Fatalf("sent %q, want Parse, Bind, Execute, Sync", types)
+	}
+	if !bytes.Contains(bodies[0], []byte("SELECT $1, $2\x00")) {
+		t.Errorf("Parse body %q lacks the SQL", bodies[0])
+	}
+	// The parameters travel in Bind, never in the SQL
+	for _, p := range []string{"example.com", "%.example.com"} {
+		if !bytes.Contains(bodies[1], append(binary.BigEndian.AppendUint32(nil, uint32(len(p))), p...)) {
+			t.Errorf("Bind body %q lacks parameter %q", bodies[1], p)
+		}
+	}
+}
+
+func TestExtendedQueryError(t *testing.T) {
+	var stream []byte
+	stream = append(stream, pgMessage('1', nil)...)
+	stream = append(stream, pgMessage('E', pgErrorBody("S", "ERROR", "C", "42601", "M", "syntax error"))...)
+	stream = append(stream, pgMessage('Z', []byte{'I'})...)
+
+	c := &pgConn{r: bufio.NewReader(bytes.NewReader(stream)), w: &bytes.Buffer{}}
+	_, err := c.extendedQuery("SELEC", nil)
+	if err == nil || !strings.Contains(err.Error(), "syntax error (SQLSTATE 42601)") {
+		t.Errorf("err = %v, want the server's error", err)
+	}
+
+	// A stream that ends before ReadyForQuery is an error too
+	c = &pgConn{r: bufio.NewReader(bytes.NewReader(pgMessage('1', nil))), w: &bytes.Buffer{}}
+	if _, err := c.extendedQuery("SELECT 1", nil); err == nil {
+		t.Error("no error for a truncated stream")
+	}
+}
+
+func TestStartupMD5(t *testing.T) {
+	salt := []byte{1, 2, 3, 4}
+	var stream []byte
+	stream = append(stream, pgMessage('R', append(binary.BigEndian.AppendUint32(nil, 5), salt...))...)
+	stream = append(stream, pgMessage('R', binary.BigEndian.AppendUint32(nil, 0))...)
+	stream = append(stream, pgMessage('S', []byte("server_version\x0016\x00"))...)
+	stream = append(stream, pgMessage('K', make([]byte, 8))...)
+	stream = append(stream, pgMessage('Z', []byte{'I'})...)
+
+	var sent bytes.Buffer
+	c := &pgConn{r: bufio.NewReader(bytes.NewReader(stream)), w: &sent}
+	if err := c.startup("guest", "certwatch", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The startup message has no type byte; skip it by its length
+	data := sent.Bytes()
+	n := binary.BigEndian.Uint32(data)
+	startup := data[4:n]
+	if binary.BigEndian.Uint32(startup) != 196608 || !bytes.Contains(startup, []byte("user\x00guest\x00database\x00certwatch\x00")) {
+		t.Errorf("startup message %q", startup)
+	}
+	types, bodies := pgFrontend(t, data[n:])
+	if string(types) != "p" {
+		t.Fatalf("sent %q after startup, want one password message", types)
+	}
+	inner := md5.Sum([]byte("secretguest"))
+	outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), salt...))
+	if want := "md5" + hex.EncodeToString(outer[:]) + "\x00"; string(bodies[0]) != want {
+		t.Errorf("password message = %q, want %q", bodies[0], want)
+	}
+}
+
+func TestStartupErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream []byte
+		want   string
+	}{
+		{"server error", pgMessage('E', pgErrorBody("S", "FATAL", "C", "28000", "M", "no such role")), "no such role"},
+		{"unsupported method", pgMessage('R', binary.BigEndian.AppendUint32(nil, 10)), "unsupported authentication method 10"},
+		{"short authentication", pgMessage('R', []byte{0}), "short authentication message"},
+		{"invalid length", []byte{'R', 0, 0, 0, 2}, "invalid message length 2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &pgConn{r: bufio.NewReader(bytes.NewReader(tt.stream)), w: &bytes.Buffer{}}
+			err := c.startup("guest", "certwatch", "")
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// Results reported by -probe.
+const (
+	probeHasData = "has-data"
+	probeNoData  = "no-data"
+	probeError   = "error"
+)
+
+// probeDomain issues the top-level query for domain only and prints whether
+// crt.sh knows any certificates for it. Nothing is followed or written.
+func probeDomain(ctx context.Context, domain string, opts *Options) error {
+	result := probeNoData
+	var lastErr error
+	anyOK := false
+	for _, q := range crtQueries(domain, opts.queryMode) {
+		entries, err := fetchRetryEmpty(ctx, domain, domain, q, opts)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		anyOK = true
+		if len(entries) > 0 {
+			result = probeHasData
+			break
+		}
+	}
+	if !anyOK {
+		result = probeError
+	}
+
+	emitResult(fmt.Sprintf("%s: %s", domain, result))
+	if result == probeError {
+		return fmt.Errorf("crt.sh query for %s failed: %w", domain, lastErr)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// progressLine is the status line redrawn in place at the bottom of an
+// interactive terminal. Log lines and results are printed above it: logAt and
+// emitResult clear it before writing and draw it again afterwards, all under
+// outMu, so worker output never tears it.
+type progressLine struct {
+	total   int
+	done    atomic.Int64
+	current atomic.Value // string: the domain started most recently
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// progress is the active status line, or nil. It is only set or read with
+// outMu held.
+var progress *progressLine
+
+// stdoutIsTerminal reports whether stdout is an interactive terminal that
+// understands the escape sequence used to redraw the status line.
+func stdoutIsTerminal() bool {
+	info, err := os.Stdout.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0 && os.Getenv("TERM") != "dumb"
+}
+
+// startProgress shows the status line for a run over total domains and
+// refreshes it twice a second until stopProgress is called.
+func startProgress(total int) *progressLine {
+	p := &progressLine{total: total, stop: make(chan struct{}), stopped: make(chan struct{})}
+	p.current.Store("")
+
+	outMu.Lock()
+	progress = p
+	p.draw()
+	outMu.Unlock()
+
+	go func() {
+		defer close(p.stopped)
+		ticker := time.NewTicker(500 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				outMu.Lock()
+				p.clear()
+				p.draw()
+				outMu.Unlock()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// stopProgress removes the status line for good. It is safe on nil.
+func (p *progressLine) stopProgress() {
+	if p == nil {
+		return
+	}
+	close(p.stop)
+	<-p.stopped
+
+	outMu.Lock()
+	p.clear()
+	progress = nil
+	outMu.Unlock()
+}
+
+func (p *progressLine) started(domain string) {
+	if p != nil {
+		p.current.Store(domain)
+	}
+}
+
+func (p *progressLine) finished() {
+	if p != nil {
+		p.done.Add(1)
+	}
+}
+
+// requeued takes n finished domains off the count again, when they are about
+// to be retried.
+func (p *progressLine) requeued(n int) {
+	if p != nil {
+		p.done.Add(-int64(n))
+	}
+}
+
+// clear erases the status line. Callers must hold outMu.
+func (p *progressLine) clear() {
+	if p != nil {
+		fmt.Fprint(os.Stdout, "\r\033[K")
+	}
+}
+
+// draw writes the status line without a newline. Callers must hold outMu.
+func (p *progressLine) draw() {
+	if p == nil {
+		return
+	}
+	current := p.current.Load().(string)
+	if len(current) > 40 {
+		current = current[:37] + "..."
+	}
+	if current != "" {
+		current = " " + current + " |"
+	}
+	// The total is unknown (0) while -stream-input is still reading
+	if p.total > 0 {
+		fmt.Fprintf(os.Stdout, "[%d/%d domains]%s %d subdomains found", p.done.Load(), p.total, current, metrics.subdomains.Load())
+	} else {
+		fmt.Fprintf(os.Stdout, "[%d domains]%s %d subdomains found", p.done.Load(), current, metrics.subdomains.Load())
+	}
+}
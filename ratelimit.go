@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hostLimiter is shared by all workers. It spaces out requests to each
+// configured host, on top of the per-goroutine -rate delay, and with
+// -workers auto also caps concurrent requests adaptively. Hosts without an
+// interval are not spaced out. A nil *hostLimiter limits nothing, but every
+// request still passes through acquire and is counted in requestRates.
+type hostLimiter struct {
+	mu       sync.Mutex
+	every    map[string]time.Duration
+	next     map[string]time.Time
+	adaptive *aimdLimiter // nil unless -workers auto
+
+	// -max-rps: the least time between any two requests, to any host
+	gap     time.Duration
+	nextAny time.Time
+}
+
+func newHostLimiter() *hostLimiter {
+	return &hostLimiter{
+		every: make(map[string]time.Duration),
+		next:  make(map[string]time.Time),
+	}
+}
+
+// spaceHost spaces out requests to host by every, unless -host-rate already
+// set an interval for it.
+func (l *hostLimiter) spaceHost(host string, every time.Duration) {
+	host = strings.ToLower(host)
+	if _, ok := l.every[host]; !ok {
+		l.every[host] = every
+	}
+}
+
+// parseHostRates parses -host-rate, a comma-separated list of host=interval
+// pairs such as "crt.sh=2s". A bare number is taken as seconds, like -rate.
+func parseHostRates(list string) (*hostLimiter, error) {
+	l := newHostLimiter()
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		host, val, ok := strings.Cut(item, "=")
+		host = strings.ToLower(strings.TrimSpace(host))
+		if !ok || host == "" {
+			return nil, fmt.Errorf("invalid entry %q (want host=interval)", item)
+		}
+		d, err := parseInterval(strings.TrimSpace(val))
+		if err != nil {
+			return nil, fmt.Errorf("invalid interval for %s: %w", host, err)
+		}
+		l.every[host] = d
+	}
+	if len(l.every) == 0 {
+		return nil, nil
+	}
+	return l, nil
+}
+
+// rpsGap returns the spacing that keeps requests at or below rps per second.
+// It is rounded up so that rps gaps never add up to less than a second.
+func rpsGap(rps float64) time.Duration {
+	return time.Duration(math.Ceil(float64(time.Second) / rps))
+}
+
+func parseInterval(s string) (time.Duration, error) {
+	if secs, err := strconv.ParseFloat(s, 64); err == nil {
+		if secs < 0 {
+			return 0, fmt.Errorf("negative interval %q", s)
+		}
+		return time.Duration(secs * float64(time.Second)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("negative interval %q", s)
+	}
+	return d, nil
+}
+
+// acquire blocks until a request to host may be sent. The returned func must
+// be called with the response status (0 if there was none) once the request
+// has finished. It returns early with an error if ctx is cancelled.
+func (l *hostLimiter) acquire(ctx context.Context, host string) (func(status int), error) {
+	release := func(int) {}
+	if l == nil {
+		requestRates.observe(time.Now())
+		return release, nil
+	}
+	if l.adaptive != nil {
+		if err := l.adaptive.acquire(ctx); err != nil {
+			return nil, err
+		}
+		release = l.adaptive.release
+	}
+	sent, err := l.wait(ctx, host)
+	if err != nil {
+		release(0)
+		return nil, err
+	}
+	// The global slot comes last, right before sending, so that waiting for
+	// a host can't bunch requests up behind it
+	slot, err := l.waitAny(ctx)
+	if err != nil {
+		release(0)
+		return nil, err
+	}
+	if slot.After(sent) {
+		sent = slot
+	}
+	requestRates.observe(sent)
+	return release, nil
+}
+
+// waitAny blocks until the next request to any host may be sent under
+// -max-rps, reserving that slot for the caller, and returns the slot's time
+// (the zero time without -max-rps).
+// Like a leaky bucket without burst, it lets requests out at most one per
+// gap however many workers wait.
+func (l *hostLimiter) waitAny(ctx context.Context) (time.Time, error) {
+	if l.gap <= 0 {
+		return time.Time{}, nil
+	}
+	l.mu.Lock()
+	at := l.nextAny
+	if now := time.Now(); at.Before(now) {
+		at = now
+	}
+	l.nextAny = at.Add(l.gap)
+	l.mu.Unlock()
+
+	sleepCtx(ctx, time.Until(at))
+	return at, ctx.Err()
+}
+
+// requestRate measures how fast requests were sent, for the end-of-run
+// summary. With -max-rps or a host interval, requests are recorded at their
+// reserved slot, which timer jitter can only delay further.
+type requestRate struct {
+	mu          sync.Mutex
+	total       int64
+	first, last time.Time
+	recent      []time.Time // send times within the last second
+	peak        int         // most requests sent within any one second
+}
+
+var requestRates requestRate
+
+func (r *requestRate) observe(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.total++
+	if r.first.IsZero() {
+		r.first = now
+	}
+	r.last = now
+	cut := 0
+	for cut < len(r.recent) && now.Sub(r.recent[cut]) >= time.Second {
+		cut++
+	}
+	r.recent = append(r.recent[cut:], now)
+	r.peak = max(r.peak, len(r.recent))
+}
+
+// summary returns the number of requests sent, the average rate between the
+// first and the last of them (0 if there were fewer than two) and the peak
+// rate.
+func (r *requestRate) summary() (total int64, avg float64, peak int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if span := r.last.Sub(r.first); span > 0 {
+		avg = float64(r.total-1) / span.Seconds()
+	}
+	return r.total, avg, r.peak
+}
+
+// wait blocks until the next request to host may be sent, reserving that
+// slot for the caller, and returns the slot's time (now for hosts without an
+// interval). It returns early with an error if ctx is cancelled.
+func (l *hostLimiter) wait(ctx context.Context, host string) (time.Time, error) {
+	host = strings.ToLower(host)
+	l.mu.Lock()
+	every, ok := l.every[host]
+	if !ok {
+		l.mu.Unlock()
+		return time.Now(), nil
+	}
+	at := l.next[host]
+	if now := time.Now(); at.Before(now) {
+		at = now
+	}
+	l.next[host] = at.Add(every)
+	l.mu.Unlock()
+
+	sleepCtx(ctx, time.Until(at))
+	return at, ctx.Err()
+}
+
+// aimdLimiter adapts the number of concurrent requests to how well the
+// upstream copes, like TCP congestion control: the limit grows by about one
+// per round of successful requests and halves when requests are throttled
+// or fail.
+type aimdLimiter struct {
+	mu       sync.Mutex
+	limit    float64
+	max      int
+	inFlight int
+	lastCut  time.Time
+	freed    chan struct{} // closed and replaced whenever a slot may be free
+}
+
+func newAIMDLimiter(max int) *aimdLimiter {
+	return &aimdLimiter{limit: 1, max: max, freed: make(chan struct{})}
+}
+
+func (a *aimdLimiter) acquire(ctx context.Context) error {
+	for {
+		a.mu.Lock()
+		if a.inFlight < int(a.limit) {
+			a.inFlight++
+			a.mu.Unlock()
+			return nil
+		}
+		freed := a.freed
+		a.mu.Unlock()
+
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (a *aimdLimiter) release(status int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.inFlight--
+
+	before := int(a.limit)
+	switch {
+	case status == http.StatusOK:
+		a.limit = min(float64(a.max), a.limit+1/a.limit)
+	case status == 0 || status == http.StatusTooManyRequests || status >= 500:
+		// Failures of concurrent requests usually share one cause, so
+		// back off only once for a burst of them
+		if time.Since(a.lastCut) > time.Second {
+			a.limit = max(1, a.limit/2)
+			a.lastCut = time.Now()
+		}
+	}
+	if after := int(a.limit); after != before {
+		logInfo(logFields{}, "Adaptive concurrency: %d → %d request(s) at a time", before, after)
+	}
+
+	close(a.freed)
+	a.freed = make(chan struct{})
+}
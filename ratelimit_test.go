@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// With -domain-workers, concurrent queries share the crt.sh host's slots, so
+// they go out no faster than one per -rate.
+func TestHostLimiterSpaceHost(t *testing.T) {
+	const every = 20 * time.Millisecond
+	l := newHostLimiter()
+	l.spaceHost("CRT.sh", every)
+
+	var mu sync.Mutex
+	var slots []time.Time
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			at, err := l.wait(context.Background(), "crt.sh")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			slots = append(slots, at)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	sort.Slice(slots, func(i, j int) bool { return slots[i].Before(slots[j]) })
+	for i := 1; i < len(slots); i++ {
+		if gap := slots[i].Sub(slots[i-1]); gap < every {
+			t.Errorf("slots %d and %d are %s apart, want at least %s", i-1, i, gap, every)
+		}
+	}
+
+	// An interval from -host-rate is kept
+	l.every["mirror.example"] = time.Second
+	l.spaceHost("mirror.example", every)
+	if got := l.every["mirror.example"]; got != time.Second {
+		t.Errorf("interval = %s, want the -host-rate value 1s", got)
+	}
+}
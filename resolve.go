@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// nameResolver looks up the subdomains found for a domain. All domains share
+// one pool of -resolve-workers lookups, independent of the crt.sh workers,
+// so resolving thousands of names cannot swamp the resolver.
+type nameResolver struct {
+	r       *net.Resolver
+	timeout time.Duration
+	sem     chan struct{}
+}
+
+// newNameResolver uses the system resolver when servers is empty, and
+// otherwise sends every lookup to one of servers in turn.
+func newNameResolver(servers []string, workers int, timeout time.Duration) *nameResolver {
+	nr := &nameResolver{
+		r:       net.DefaultResolver,
+		timeout: timeout,
+		sem:     make(chan struct{}, max(workers, 1)),
+	}
+	if len(servers) > 0 {
+		var next atomic.Uint64
+		nr.r = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				server := servers[(next.Add(1)-1)%uint64(len(servers))]
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+	return nr
+}
+
+// parseResolvers parses a comma-separated list of DNS servers. Port 53 is
+// assumed when none is given.
+func parseResolvers(list string) ([]string, error) {
+	var servers []string
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		addr := s
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			addr = net.JoinHostPort(strings.Trim(s, "[]"), "53")
+		}
+		host, _, _ := net.SplitHostPort(addr)
+		if net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("invalid resolver %q: must be an IP address", s)
+		}
+		servers = append(servers, addr)
+	}
+	return servers, nil
+}
+
+// resolveAll looks up every name and returns the addresses of those that
+// resolve. Names that fail to resolve are left out.
+func (nr *nameResolver) resolveAll(ctx context.Context, names []string) map[string][]string {
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		resolved = make(map[string][]string)
+	)
+	for _, name := range names {
+		select {
+		case nr.sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return resolved
+		}
+		wg.Add(1)
+		go func() {
+			defer func() { <-nr.sem; wg.Done() }()
+			lctx, cancel := context.WithTimeout(ctx, nr.timeout)
+			addrs, err := nr.r.LookupHost(lctx, name)
+			cancel()
+			if err != nil || len(addrs) == 0 {
+				return
+			}
+			sort.Strings(addrs)
+			mu.Lock()
+			resolved[name] = addrs
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return resolved
+}
+
+// writeResolved writes one "name addr1,addr2" line per resolved name, in
+// the order given by sortMode.
+func writeResolved(out outputBackend, name string, resolved map[string][]string, sortMode string) error {
+	names := make([]string, 0, len(resolved))
+	for n := range resolved {
+		names = append(names, n)
+	}
+	sortNames(names, sortMode)
+
+	var sb strings.Builder
+	for _, n := range names {
+		sb.WriteString(n + " " + strings.Join(resolved[n], ",") + "\n")
+	}
+	return out.WriteFile(name, []byte(sb.String()))
+}
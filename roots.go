@@ -0,0 +1,24 @@
+package main
+
+import "golang.org/x/net/publicsuffix"
+
+// registrableDomain returns the apex domain (eTLD+1) that name belongs to
+// according to the Public Suffix List, e.g. "a.b.example.co.uk" →
+// "example.co.uk" and "a.b.user.github.io" → "user.github.io", or "" if name
+// is itself a public suffix.
+func registrableDomain(name string) string {
+	root, err := publicsuffix.EffectiveTLDPlusOne(name)
+	if err != nil {
+		return ""
+	}
+	return root
+}
+
+// addRoots adds the apex domain of every name in names to roots.
+func addRoots(roots *StringSet, names *StringSet) {
+	for _, n := range names.Sorted() {
+		if r := registrableDomain(n); r != "" {
+			roots.Add(r)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestRegistrableDomain(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"a.b.example.com", "example.com"},
+		{"example.com", "example.com"},
+		{"a.b.example.co.uk", "example.co.uk"},
+		{"www.example.gv.at", "example.gv.at"},
+		{"a.user.github.io", "user.github.io"},
+		{"app.herokuapp.com", "app.herokuapp.com"},
+		{"assets.bucket.s3.amazonaws.com", "bucket.s3.amazonaws.com"},
+		{"d111111abcdef8.cloudfront.net", "d111111abcdef8.cloudfront.net"},
+		{"v2.project.appspot.com", "project.appspot.com"},
+		{"co.uk", ""},
+		{"com", ""},
+	}
+	for _, tt := range tests {
+		if got := registrableDomain(tt.in); got != tt.want {
+			t.Errorf("registrableDomain(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
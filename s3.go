@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3Backend stores results in an S3 (or S3-compatible) bucket. Requests are
+// signed with AWS Signature Version 4 using the standard AWS_* environment
+// variables, and use path-style URLs so that MinIO and similar work too.
+type s3Backend struct {
+	client       *http.Client
+	endpoint     *url.URL
+	bucket       string
+	prefix       string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+func newS3Backend(bucket, prefix, endpoint string) (*s3Backend, error) {
+	b := &s3Backend{
+		client:       &http.Client{Timeout: 60 * time.Second},
+		bucket:       bucket,
+		prefix:       strings.Trim(prefix, "/"),
+		region:       os.Getenv("AWS_REGION"),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if b.region == "" {
+		b.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if b.region == "" {
+		b.region = "us-east-1"
+	}
+	if b.accessKey == "" || b.secretKey == "" {
+		return nil, errors.New("-s3-bucket requires AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY to be set")
+	}
+
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", b.region)
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid -s3-endpoint %q", endpoint)
+	}
+	b.endpoint = u
+	return b, nil
+}
+
+func (b *s3Backend) key(name string) string {
+	if b.prefix == "" {
+		return name
+	}
+	return path.Join(b.prefix, name)
+}
+
+func (b *s3Backend) Location(name string) string {
+	return "s3://" + b.bucket + "/" + b.key(name)
+}
+
+func (b *s3Backend) WriteFile(name string, data []byte) error {
+	resp, err := b.do(http.MethodPut, name, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (b *s3Backend) ReadFile(name string) ([]byte, error) {
+	resp, err := b.do(http.MethodGet, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+func (b *s3Backend) Size(name string) (int64, error) {
+	resp, err := b.do(http.MethodHead, name, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.ContentLength, nil
+}
+
+// do sends a signed request for the object name. A 404 is reported as an
+// error wrapping os.ErrNotExist; other non-2xx statuses are errors too.
+func (b *s3Backend) do(method, name string, body []byte) (*http.Response, error) {
+	u := *b.endpoint
+	u.Path = "/" + b.bucket + "/" + b.key(name)
+	u.RawPath = s3EscapePath(u.Path)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	b.sign(req, body, time.Now().UTC())
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %w", b.Location(name), os.ErrNotExist)
+	}
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("S3 %s %s: HTTP %d: %s", method, b.Location(name), resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// sign adds AWS Signature Version 4 headers to req. Every header already set
+// on req is signed, along with Host and the X-Amz-* headers added here.
+func (b *s3Backend) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if b.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", b.sessionToken)
+	}
+
+	values := map[string]string{"host": req.URL.Host}
+	for name, v := range req.Header {
+		values[strings.ToLower(name)] = strings.Join(strings.Fields(strings.Join(v, ",")), " ")
+	}
+	signed := make([]string, 0, len(values))
+	for name := range values {
+		signed = append(signed, name)
+	}
+	sort.Strings(signed)
+
+	var headers strings.Builder
+	for _, h := range signed {
+		headers.WriteString(h + ":" + values[h] + "\n")
+	}
+	signedHeaders := strings.Join(signed, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		s3CanonicalQuery(req.URL.Query()),
+		headers.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + b.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+b.secretKey), day)
+	key = hmacSHA256(key, b.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		b.accessKey, scope, signedHeaders, signature))
+}
+
+// s3CanonicalQuery returns the SigV4 canonical query string: parameters
+// sorted by name, then value, with names and values URI-encoded.
+func s3CanonicalQuery(q url.Values) string {
+	var params []string
+	for name, values := range q {
+		for _, v := range values {
+			params = append(params, s3Escape(name, false)+"="+s3Escape(v, false))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// s3EscapePath URI-encodes every byte of p except unreserved characters and
+// slashes, as SigV4 requires for the canonical URI.
+func s3EscapePath(p string) string {
+	return s3Escape(p, true)
+}
+
+// s3Escape URI-encodes every byte of s except unreserved characters and,
+// if keepSlash is set, slashes.
+func s3Escape(s string, keepSlash bool) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && keepSlash:
+			sb.WriteByte(c)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
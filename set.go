@@ -0,0 +1,63 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// StringSet is a set of names that is safe for concurrent use.
+type StringSet struct {
+	mu    sync.RWMutex
+	items map[string]struct{}
+}
+
+func NewStringSet() *StringSet {
+	return &StringSet{items: make(map[string]struct{})}
+}
+
+// Add inserts s and reports whether it was not in the set before.
+func (ss *StringSet) Add(s string) bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if _, ok := ss.items[s]; ok {
+		return false
+	}
+	ss.items[s] = struct{}{}
+	return true
+}
+
+func (ss *StringSet) Contains(s string) bool {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	_, ok := ss.items[s]
+	return ok
+}
+
+func (ss *StringSet) Len() int {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	return len(ss.items)
+}
+
+// Sorted returns a snapshot of the set in lexicographic order.
+func (ss *StringSet) Sorted() []string {
+	ss.mu.RLock()
+	items := make([]string, 0, len(ss.items))
+	for s := range ss.items {
+		items = append(items, s)
+	}
+	ss.mu.RUnlock()
+	sort.Strings(items)
+	return items
+}
+
+// union returns a new set holding every name in sets.
+func union(sets ...*StringSet) *StringSet {
+	out := NewStringSet()
+	for _, set := range sets {
+		for _, s := range set.Sorted() {
+			out.Add(s)
+		}
+	}
+	return out
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// Run with -race: workers share one set per domain.
+func TestStringSetConcurrent(t *testing.T) {
+	const workers, perWorker = 8, 200
+	set := NewStringSet()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				// Every name is added by two workers, so half the adds are repeats
+				name := fmt.Sprintf("h%d.example.com", (w/2)*perWorker+i)
+				set.Add(name)
+				if !set.Contains(name) {
+					t.Errorf("Contains(%q) = false right after Add", name)
+				}
+				if i%50 == 0 {
+					set.Sorted()
+					set.Len()
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if want := workers / 2 * perWorker; set.Len() != want {
+		t.Errorf("Len() = %d, want %d", set.Len(), want)
+	}
+	if got := len(set.Sorted()); got != set.Len() {
+		t.Errorf("len(Sorted()) = %d, want %d", got, set.Len())
+	}
+}
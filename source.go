@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// certSource looks up the certificates matching a crt.sh query, where q is
+// "%.name" (names below name) or "name" (name itself). domain and current
+// are only used for logging. It returns an error if the lookup failed.
+type certSource interface {
+	fetch(ctx context.Context, opts *Options, domain, current, q string) ([]CRTEntry, error)
+	// id identifies the source in -with-source output.
+	id() sourceMask
+}
+
+// sourceMask is a set of sources, one bit each. It records which sources
+// reported a name.
+type sourceMask uint8
+
+const (
+	sourceCrtshAPI sourceMask = 1 << iota
+	sourceCrtshDB
+)
+
+// sourceNames are the names of the sourceMask bits, in bit order.
+var sourceNames = [...]string{"crtsh", "crtsh-db"}
+
+// names returns the names of the sources in m.
+func (m sourceMask) names() []string {
+	names := []string{}
+	for i, name := range sourceNames {
+		if m&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+type sourcedName struct {
+	Name    string   `json:"name"`
+	Sources []string `json:"sources"`
+}
+
+// writeSources writes the sources of every name in subs as JSON, in the
+// same order as subs.txt (-with-source).
+func writeSources(out outputBackend, name string, subs *StringSet, sources map[string]sourceMask, sortMode string) error {
+	names := sortedSet(subs, sortMode)
+	list := make([]sourcedName, 0, len(names))
+	for _, n := range names {
+		list = append(list, sourcedName{Name: n, Sources: sources[n].names()})
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return out.WriteFile(name, append(data, '\n'))
+}
+
+// Values of -backend.
+const (
+	backendHTTP     = "http"
+	backendPostgres = "postgres"
+)
+
+// httpSource queries the crt.sh JSON API at opts.baseURL. It is the default.
+type httpSource struct{}
+
+func (s *httpSource) id() sourceMask { return sourceCrtshAPI }
+
+func (s *httpSource) fetch(ctx context.Context, opts *Options, domain, current, q string) ([]CRTEntry, error) {
+	return queryCrt(ctx, opts, domain, current, "q", q)
+}
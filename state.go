@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// runState is the resume manifest: the set of input domains that completed
+// successfully. It is rewritten after every finished domain so that an
+// interrupted run can pick up where it stopped. In append mode
+// (-stream-input), finished domains are added to the file one line at a time
+// instead, and are not kept in memory.
+type runState struct {
+	mu        sync.Mutex
+	path      string
+	completed map[string]struct{}
+	f         *os.File // non-nil in append mode
+}
+
+type runStateFile struct {
+	Completed []string `json:"completed"`
+}
+
+// loadRunState reads the manifest at path. A missing file yields an empty
+// state. Both the rewritten form, a JSON object, and the append-mode form,
+// one JSON string per line, are accepted.
+func loadRunState(path string) (*runState, error) {
+	st := &runState{path: path, completed: make(map[string]struct{})}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read state file '%s': %w", path, err)
+	}
+
+	if trimmed := bytes.TrimSpace(data); len(trimmed) == 0 || trimmed[0] != '{' {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		for {
+			var d string
+			if err := dec.Decode(&d); err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, fmt.Errorf("invalid state file '%s': %w", path, err)
+			}
+			st.completed[d] = struct{}{}
+		}
+		return st, nil
+	}
+
+	var file runStateFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid state file '%s': %w", path, err)
+	}
+	for _, d := range file.Completed {
+		st.completed[d] = struct{}{}
+	}
+	return st, nil
+}
+
+// startAppend switches st to append mode. The manifest is started over in
+// the one-line-per-domain form, holding the domains st already knows (those
+// of a resumed run), so it is written in full only this once.
+func (st *runState) startAppend() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	names := make([]string, 0, len(st.completed))
+	for d := range st.completed {
+		names = append(names, d)
+	}
+	sort.Strings(names)
+
+	f, err := os.Create(st.path)
+	if err != nil {
+		return fmt.Errorf("could not create state file '%s': %w", st.path, err)
+	}
+	w := bufio.NewWriter(f)
+	for _, d := range names {
+		line, _ := json.Marshal(d)
+		w.Write(append(line, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("could not write state file '%s': %w", st.path, err)
+	}
+	st.f = f
+	return nil
+}
+
+func (st *runState) isCompleted(domain string) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	_, ok := st.completed[domain]
+	return ok
+}
+
+// markCompleted records domain and saves the manifest.
+func (st *runState) markCompleted(domain string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.f != nil {
+		line, err := json.Marshal(domain)
+		if err != nil {
+			return err
+		}
+		_, err = st.f.Write(append(line, '\n'))
+		return err
+	}
+	st.completed[domain] = struct{}{}
+	return st.save()
+}
+
+// save writes the manifest. Callers must hold st.mu.
+func (st *runState) save() error {
+	file := runStateFile{Completed: make([]string, 0, len(st.completed))}
+	for d := range st.completed {
+		file.Completed = append(file.Completed, d)
+	}
+	sort.Strings(file.Completed)
+	return writeJSONAtomic(st.path, file)
+}
+
+// close closes the manifest in append mode.
+func (st *runState) close() error {
+	if st.f == nil {
+		return nil
+	}
+	return st.f.Close()
+}
+
+// writeJSONAtomic writes v as JSON to path via a temporary file and rename,
+// so a crash never leaves a half-written file behind.
+func writeJSONAtomic(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".crt-subfinder-state-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// sinceIDs holds the highest crt.sh certificate ID seen per input domain, so
+// that -since-id-file runs only report certificates logged since the last run.
+type sinceIDs struct {
+	mu   sync.Mutex
+	path string
+	ids  map[string]int64
+}
+
+// loadSinceIDs reads the high-water marks at path. A missing file yields none.
+func loadSinceIDs(path string) (*sinceIDs, error) {
+	s := &sinceIDs{path: path, ids: make(map[string]int64)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read since-id file '%s': %w", path, err)
+	}
+	if err := json.Unmarshal(data, &s.ids); err != nil {
+		return nil, fmt.Errorf("invalid since-id file '%s': %w", path, err)
+	}
+	return s, nil
+}
+
+// get returns the mark for domain, or 0 if there is none. A nil *sinceIDs
+// has no marks.
+func (s *sinceIDs) get(domain string) int64 {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ids[domain]
+}
+
+// update raises the mark for domain to id and saves the file.
+func (s *sinceIDs) update(domain string, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if id <= s.ids[domain] {
+		return nil
+	}
+	s.ids[domain] = id
+	return writeJSONAtomic(s.path, s.ids)
+}
+
+// failureLog records the domains that failed (-failures) as one
+// "domain<TAB>reason" line each. Input files ignore everything after the
+// name, so the file can be fed straight back in for a retry run.
+type failureLog struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// openFailureLog creates or truncates the file at path.
+func openFailureLog(path string) (*failureLog, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not create failures file '%s': %w", path, err)
+	}
+	return &failureLog{f: f}, nil
+}
+
+// record adds domain with the reason it failed. A nil *failureLog records
+// nothing.
+func (l *failureLog) record(domain string, reason error) {
+	if l == nil {
+		return
+	}
+	msg := strings.Join(strings.Fields(reason.Error()), " ")
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := fmt.Fprintf(l.f, "%s\t%s\n", domain, msg); err != nil {
+		logError(logFields{Domain: domain}, "Error writing failures file: %v", err)
+	}
+}
+
+func (l *failureLog) close() error {
+	if l == nil {
+		return nil
+	}
+	return l.f.Close()
+}
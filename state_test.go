@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunStateAppend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	// A manifest written by a run without -stream-input
+	st := &runState{path: path, completed: make(map[string]struct{})}
+	if err := st.markCompleted("a.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Resumed with -stream-input: later domains are appended, not kept
+	st, err := loadRunState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.startAppend(); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []string{"b.com", "c.com"} {
+		if err := st.markCompleted(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(st.completed) != 1 {
+		t.Errorf("%d domains in memory, want only the resumed one", len(st.completed))
+	}
+	if err := st.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), "\"a.com\"\n\"b.com\"\n\"c.com\"\n"; got != want {
+		t.Errorf("manifest = %q, want %q", got, want)
+	}
+
+	st, err = loadRunState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []string{"a.com", "b.com", "c.com"} {
+		if !st.isCompleted(d) {
+			t.Errorf("%s not completed after reload", d)
+		}
+	}
+}
+
+func TestLoadRunStateInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(path, []byte("\"a.com\"\nb.com\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadRunState(path); err == nil || !strings.Contains(err.Error(), "invalid state file") {
+		t.Errorf("err = %v, want invalid state file", err)
+	}
+}
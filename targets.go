@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// targetSpec is one entry of a .json input file. Fields that are left out
+// fall back to the global flags.
+type targetSpec struct {
+	Domain string   `json:"domain"`
+	Depth  *int     `json:"depth"` // like -max-depth
+	Rate   string   `json:"rate"`  // like -rate, e.g. "2s" or "0.5"
+	Scope  []string `json:"scope"` // like -scope with -scope-results
+}
+
+// domainOverrides are the parsed per-domain settings of a targetSpec.
+type domainOverrides struct {
+	depth *int
+	rate  *time.Duration
+	scope []*regexp.Regexp
+}
+
+// readTargetFile reads a .json input file: an array of targetSpec objects.
+// It returns the domains in file order and the overrides for those that
+// have any, keyed by the normalized domain.
+func readTargetFile(path string) ([]string, map[string]*domainOverrides, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not open '%s': %w", path, err)
+	}
+
+	var specs []targetSpec
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&specs); err != nil {
+		return nil, nil, fmt.Errorf("invalid JSON in '%s': %w", path, err)
+	}
+
+	var domains []string
+	overrides := make(map[string]*domainOverrides)
+	for i, spec := range specs {
+		names, _, _ := prepareDomains([]string{spec.Domain})
+		if len(names) == 0 {
+			return nil, nil, fmt.Errorf("'%s': entry %d: invalid domain %q", path, i+1, spec.Domain)
+		}
+		domain := names[0]
+		domains = append(domains, domain)
+
+		var o domainOverrides
+		if spec.Depth != nil {
+			if *spec.Depth < -1 {
+				return nil, nil, fmt.Errorf("'%s': %s: depth must be -1 or more", path, domain)
+			}
+			o.depth = spec.Depth
+		}
+		if spec.Rate != "" {
+			d, err := parseInterval(spec.Rate)
+			if err != nil {
+				return nil, nil, fmt.Errorf("'%s': %s: invalid rate: %w", path, domain, err)
+			}
+			o.rate = &d
+		}
+		if len(spec.Scope) > 0 {
+			o.scope, err = parseScope(strings.Join(spec.Scope, ","))
+			if err != nil {
+				return nil, nil, fmt.Errorf("'%s': %s: invalid scope: %w", path, domain, err)
+			}
+		}
+		if o.depth != nil || o.rate != nil || o.scope != nil {
+			overrides[domain] = &o
+		}
+	}
+	return domains, overrides, nil
+}
+
+// apply returns opts with the overrides applied, or opts itself if there are
+// none. opts is never modified.
+func (o *domainOverrides) apply(opts *Options) *Options {
+	if o == nil {
+		return opts
+	}
+	c := *opts
+	if o.depth != nil {
+		c.maxDepth = *o.depth
+		c.noRecurse = false
+	}
+	if o.rate != nil {
+		c.rateLimit = *o.rate
+	}
+	if o.scope != nil {
+		c.scope = o.scope
+		c.scopeResults = true
+	}
+	return &c
+}